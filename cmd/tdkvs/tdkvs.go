@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/orellazri/tdkvs/internal/master"
 	"github.com/orellazri/tdkvs/internal/utils"
@@ -14,13 +15,22 @@ import (
 func main() {
 	masterCmd := flag.NewFlagSet("master", flag.ExitOnError)
 	masterConfigPath := masterCmd.String("config", "", "path to config file for the master server")
-	masterDeleteVolume := masterCmd.Int("delete", -1, "delete a volume server")
+	masterDeleteVolume := masterCmd.Int("delete", -1, "delete a volume server while the master server is down")
+	masterPlan := masterCmd.Bool("plan", false, "print the keys a rebalance to the volume servers in the config would move, without moving them")
+	masterRehash := masterCmd.Bool("rehash", false, "move every key to its path and volume servers under the hash function in the config")
+	masterRebuild := masterCmd.Bool("rebuild", false, "rebuild the metadata of every key from the volume servers into an empty badger directory")
+	masterRename := masterCmd.String("rename", "", "point the buckets of volume servers that moved to their new urls (old=new, comma separated)")
+	masterReconcile := masterCmd.Bool("reconcile", false, "decommission volume servers that hold keys but are not in the config")
+
+	fsckCmd := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fsckConfigPath := fsckCmd.String("config", "", "path to config file for the master server")
+	fsckRepair := fsckCmd.Bool("repair", false, "repair the inconsistencies that are found")
 
 	volumeCmd := flag.NewFlagSet("volume", flag.ExitOnError)
 	volumeConfigPath := volumeCmd.String("config", "", "path to config file for the volume server")
 
 	if len(os.Args) < 2 {
-		fmt.Println("expected `master` or `volume` subcommands")
+		fmt.Println("expected `master`, `volume` or `fsck` subcommands")
 		os.Exit(1)
 	}
 
@@ -42,10 +52,28 @@ func main() {
 			os.Exit(1)
 		}
 		config.DeleteVolume = *masterDeleteVolume
+		config.Reconcile = *masterReconcile
+		if *masterRename != "" {
+			config.Rename = make(map[string]string)
+			for _, rename := range strings.Split(*masterRename, ",") {
+				urls := strings.SplitN(rename, "=", 2)
+				if len(urls) != 2 || urls[0] == "" || urls[1] == "" {
+					fmt.Println("renames must be given as old=new")
+					os.Exit(1)
+				}
+				config.Rename[strings.TrimSuffix(urls[0], "/")] = strings.TrimSuffix(urls[1], "/")
+			}
+		}
 
-		// Check if delete volume flag is set
+		// Check if delete volume, plan, rehash or rebuild flags are set
 		if *masterDeleteVolume != -1 {
 			master.Start(config, master.DeleteVolume)
+		} else if *masterPlan {
+			master.Start(config, master.Plan)
+		} else if *masterRehash {
+			master.Start(config, master.Rehash)
+		} else if *masterRebuild {
+			master.Start(config, master.Rebuild)
 		} else {
 			master.Start(config, master.Normal)
 		}
@@ -66,8 +94,26 @@ func main() {
 		}
 
 		volume.Start(config)
+	case "fsck":
+		fsckCmd.Parse(os.Args[2:])
+
+		if *fsckConfigPath == "" {
+			fmt.Println("config file is required. specify a path with -config")
+			os.Exit(1)
+		}
+		config := &master.Config{}
+		data, err := os.ReadFile(*fsckConfigPath)
+		utils.AbortOnError(err)
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			fmt.Println("The config yaml file specified is invalid!")
+			os.Exit(1)
+		}
+		config.Repair = *fsckRepair
+
+		master.Start(config, master.Fsck)
 	default:
-		fmt.Println("expected `master` or `volume` subcommands")
+		fmt.Println("expected `master`, `volume` or `fsck` subcommands")
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,184 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Bucket as listed by the admin API
+type volumeInfo struct {
+	Index  int    `json:"index"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"` // Amount of buckets the volume server should have
+	Zone   string `json:"zone,omitempty"`
+	Rack   string `json:"rack,omitempty"`
+	Health string `json:"health"` // Health state of the volume server, from its heartbeats
+}
+
+// Handle listing volume servers
+func listVolumesHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	c.mu.RLock()
+	volumes := []volumeInfo{}
+	for i, url := range c.buckets {
+		volumes = append(volumes, volumeInfo{i, url, c.weights[url], c.labels[url].Zone, c.labels[url].Rack, c.health.state(url)})
+	}
+	rebalancing := c.rebalancing
+	retiring := c.retiring
+	c.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"volumes":     volumes,
+		"replicas":    c.config.Replicas,
+		"rebalancing": rebalancing,
+		"retiring":    retiring,
+	})
+}
+
+// Handle adding a volume server, or changing its weight or labels, at runtime
+// The request body is the url of the volume server, the weight is given
+// with the `weight` query parameter (defaults to 1) and the labels with the
+// `zone` and `rack` query parameters. Settings that are not given are kept
+// for an existing volume server. Keys are rebalanced in the background while
+// the master server keeps serving requests
+func addVolumeHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "An error occurred while parsing request body", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	url := strings.TrimSuffix(strings.TrimSpace(string(data)), "/")
+	if url == "" {
+		http.Error(w, "Volume server url is required", http.StatusBadRequest)
+		return
+	}
+
+	weight := 1
+	weightParam := r.URL.Query().Get("weight")
+	if weightParam != "" {
+		weight, err = strconv.Atoi(weightParam)
+		if err != nil || weight < 1 {
+			http.Error(w, "Weight must be a positive number. Decommission the volume server to remove it", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Make sure the volume server is up and is the one we expect before
+	// routing keys to it
+	err = c.verifyVolume(url)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	c.mu.Lock()
+	if c.rebalancing {
+		c.mu.Unlock()
+		http.Error(w, "A rebalance is already running", http.StatusConflict)
+		return
+	}
+	if c.retiring != nil {
+		c.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Bucket %v of volume server %v is being retired. Retry its decommission first", c.retiring.Bucket, c.retiring.Volume), http.StatusConflict)
+		return
+	}
+	exists := containsVolume(c.buckets, url)
+	if exists && weightParam == "" {
+		weight = c.weights[url]
+	}
+	l := c.labels[url]
+	query := r.URL.Query()
+	if query.Has("zone") {
+		l.Zone = strings.TrimSpace(query.Get("zone"))
+	}
+	if query.Has("rack") {
+		l.Rack = strings.TrimSpace(query.Get("rack"))
+	}
+	if exists && c.weights[url] == weight && c.labels[url] == l {
+		c.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Volume server %v already exists with weight %v", url, c.weights[url]), http.StatusBadRequest)
+		return
+	}
+
+	// Claim the rebalance before writing the table, so no other admin
+	// operation changes it meanwhile
+	buckets, grew := mergeBuckets(c.buckets, []Volume{{URL: url, Weight: weight}})
+	c.rebalancing = true
+	c.mu.Unlock()
+
+	// Write the table without holding c.mu, since replicating it may take a
+	// while
+	if grew {
+		err = c.db.Update(func(txn kvTxn) error {
+			return putBuckets(txn, buckets)
+		})
+		if err != nil {
+			c.mu.Lock()
+			c.rebalancing = false
+			c.mu.Unlock()
+			http.Error(w, fmt.Sprintf("An error occurred while adding volume server %v", url), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+
+	c.mu.Lock()
+	// Replace the table instead of appending in place, since handlers may be
+	// using the current one
+	if grew {
+		c.buckets = buckets
+	}
+	c.weights[url] = weight
+	delete(c.spares, url)
+
+	// Replace the labels instead of changing them in place, since running
+	// rebalances may be using the current ones
+	volumeLabels := make(map[string]labels)
+	for u, other := range c.labels {
+		volumeLabels[u] = other
+	}
+	if l == (labels{}) {
+		delete(volumeLabels, url)
+	} else {
+		volumeLabels[url] = l
+	}
+	c.labels = volumeLabels
+	c.mu.Unlock()
+
+	// A lower weight retires buckets of the volume server instead
+	if !grew {
+		c.setRetiring(c.nextRetirement())
+	}
+
+	log.Printf("Volume server %v has weight %v, zone \"%v\" and rack \"%v\"", url, weight, l.Zone, l.Rack)
+	go runRebalance(c)
+
+	w.WriteHeader(http.StatusAccepted)
+	if exists {
+		fmt.Fprintf(w, "changed volume server %v to weight %v, zone \"%v\" and rack \"%v\". rebalancing", url, weight, l.Zone, l.Rack)
+	} else {
+		fmt.Fprintf(w, "added volume server %v with weight %v. rebalancing", url, weight)
+	}
+}
+
+// Rebalance keys in the background and mark the rebalance as done
+func runRebalance(c *context) {
+	err := rebalanceVolumes(c)
+	if errors.Is(err, errRebalanceCancelled) {
+		log.Println("Rebalance cancelled")
+	} else if err != nil {
+		log.Printf("Rebalance failed: %v", err)
+	}
+
+	c.mu.Lock()
+	c.rebalancing = false
+	c.mu.Unlock()
+}
@@ -0,0 +1,157 @@
+package master
+
+import (
+	"encoding/json"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Key of the bucket table in BadgerDB
+// Metakeys and placement use bucket numbers, and the table maps every
+// bucket to the url of the volume server that holds it, so a volume server
+// can be replaced without touching the metakeys of its keys
+const bucketsKey = "_meta_buckets"
+
+// Retrieve the bucket table
+// Returns badger.ErrKeyNotFound if it was never set
+func getBuckets(db *store) ([]string, error) {
+	var buckets []string
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(bucketsKey))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &buckets)
+		})
+	})
+	return buckets, err
+}
+
+// Persist the bucket table in a transaction
+func putBuckets(txn kvTxn, buckets []string) error {
+	value, err := json.Marshal(buckets)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(bucketsKey), value)
+}
+
+// Add buckets to the end of the bucket table for the volume servers that
+// have less buckets than their weight, in the order they are given
+// Returns the new table and whether it changed
+func mergeBuckets(buckets []string, volumes []Volume) ([]string, bool) {
+	merged := append([]string{}, buckets...)
+	changed := false
+	for _, volume := range volumes {
+		for i := countVolume(merged, volume.URL); i < volume.Weight; i++ {
+			merged = append(merged, volume.URL)
+			changed = true
+		}
+	}
+	return merged, changed
+}
+
+// Count the buckets of a volume server
+func countVolume(buckets []string, url string) int {
+	count := 0
+	for _, u := range buckets {
+		if u == url {
+			count++
+		}
+	}
+	return count
+}
+
+// Choose the next bucket to retire, so no volume server has more buckets
+// than its weight. Volume servers without a weight are left as they are
+// The last bucket of a volume server is chosen, since the last bucket can
+// be removed without remapping it. Its keys are copied to the spare of the
+// volume server, if it has one
+// Returns nil if no bucket has to be retired
+func nextRetirement(buckets []string, weights map[string]int, spares map[string]string) *retirement {
+	counts := make(map[string]int)
+	for _, url := range buckets {
+		counts[url]++
+	}
+
+	for bucket := len(buckets) - 1; bucket >= 0; bucket-- {
+		url := buckets[bucket]
+		weight, ok := weights[url]
+		if !ok || counts[url] <= weight {
+			continue
+		}
+
+		r := newRetirement(buckets, bucket, spares[url])
+		r.Weight = weight
+		return r
+	}
+	return nil
+}
+
+// Choose the next bucket to retire from the current bucket table
+func (c *context) nextRetirement() *retirement {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return nextRetirement(c.buckets, c.weights, c.spares)
+}
+
+// Check if a list of urls contains a volume server
+func containsVolume(urls []string, url string) bool {
+	for _, u := range urls {
+		if u == url {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the volume servers holding the given buckets, without duplicates
+func (c *context) bucketVolumes(buckets []uint32) []string {
+	table := c.volumes()
+
+	urls := []string{}
+	for _, bucket := range buckets {
+		if !containsVolume(urls, table[bucket]) {
+			urls = append(urls, table[bucket])
+		}
+	}
+	return urls
+}
+
+// Return the volume servers that writes to the given buckets go to,
+// without duplicates
+// While a bucket is remapped to another volume server, writes go to both
+// of them
+func (c *context) writeVolumes(buckets []uint32) []string {
+	urls := c.bucketVolumes(buckets)
+
+	c.mu.RLock()
+	retiring := c.retiring
+	c.mu.RUnlock()
+
+	if retiring.remapping() && !containsVolume(urls, retiring.To) {
+		for _, bucket := range buckets {
+			if bucket == retiring.Bucket {
+				urls = append(urls, retiring.To)
+				break
+			}
+		}
+	}
+	return urls
+}
+
+// Return the volume servers holding the buckets in from that no bucket in
+// to is written to, i.e. the ones to delete a moved key from
+func (c *context) staleVolumes(from []uint32, to []uint32) []string {
+	current := c.writeVolumes(to)
+
+	urls := []string{}
+	for _, url := range c.bucketVolumes(from) {
+		if !containsVolume(current, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
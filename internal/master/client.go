@@ -0,0 +1,262 @@
+package master
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Retrieve a value from a volume server
+func getFromVolume(volume string, key string, hash uint64, as string) ([]byte, error) {
+	resp, err := http.Get(fmt.Sprintf("%v/get/%v?hash=%v&as=%v", volume, key, hash, as))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New("respose from volume server is not 200 OK")
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// Set a value in a volume server
+func setInVolume(volume string, key string, hash uint64, value []byte) error {
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%v/set/%v?hash=%v", volume, key, hash), bytes.NewBuffer(value))
+	if err != nil {
+		return err
+	}
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.New("response from volume server is not 200 OK")
+	}
+	return nil
+}
+
+// Delete a value from a volume server
+// Deleting a value that does not exist in the volume server is not an error
+func deleteFromVolume(volume string, key string, hash uint64) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%v/delete/%v?hash=%v", volume, key, hash), strings.NewReader(""))
+	if err != nil {
+		return err
+	}
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != http.StatusNotFound {
+		return errors.New("response from volume server is not 200 OK")
+	}
+	return nil
+}
+
+// Retrieve the checksum of a value from a volume server
+func checksumFromVolume(volume string, key string, hash uint64) (string, error) {
+	resp, err := http.Get(fmt.Sprintf("%v/checksum/%v?hash=%v", volume, key, hash))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", errors.New("response from volume server is not 200 OK")
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// Returned when a volume server belongs to another cluster
+var errForeignVolume = errors.New("volume server belongs to another cluster")
+
+// Identity of the storage directory of a volume server
+type volumeIdentity struct {
+	VolumeID  string `json:"volume_id"`
+	ClusterID string `json:"cluster_id"`
+}
+
+// Retrieve the identity of a volume server without claiming it
+func identityOfVolume(volume string) (*volumeIdentity, error) {
+	resp, err := http.Get(fmt.Sprintf("%v/identity", volume))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New("response from volume server is not 200 OK")
+	}
+
+	id := &volumeIdentity{}
+	err = json.NewDecoder(resp.Body).Decode(id)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Claim a volume server for a cluster, which also checks that it is up
+// A volume server that belongs to another cluster refuses to be claimed
+// Returns the identity of the volume server
+func claimVolume(volume string, clusterID string) (*volumeIdentity, error) {
+	resp, err := http.Post(fmt.Sprintf("%v/identity?cluster=%v", volume, url.QueryEscape(clusterID)), "text/plain", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%w: %v", errForeignVolume, strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode != 200 {
+		return nil, errors.New("response from volume server is not 200 OK")
+	}
+
+	id := &volumeIdentity{}
+	err = json.NewDecoder(resp.Body).Decode(id)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Response of a volume server that pushed a value to another one
+type pushResponse struct {
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// Instruct a volume server to push a value directly to another volume server,
+// where it is stored under the destination hash
+// Returns the size and checksum of the value that was pushed
+func pushFromVolume(volume string, key string, hash uint64, destination string, destinationHash uint64) (int, string, error) {
+	resp, err := http.Post(fmt.Sprintf("%v/push/%v?hash=%v&to=%v&to_hash=%v", volume, key, hash, url.QueryEscape(destination), destinationHash), "text/plain", nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, "", errors.New("response from volume server is not 200 OK")
+	}
+
+	push := &pushResponse{}
+	err = json.NewDecoder(resp.Body).Decode(push)
+	if err != nil {
+		return 0, "", err
+	}
+	return push.Size, push.Checksum, nil
+}
+
+// Key stored in a volume server, as listed by it
+type volumeKey struct {
+	Key     string `json:"key"`
+	Hash    string `json:"hash"`
+	Size    int64  `json:"size"`
+	Partial bool   `json:"partial,omitempty"` // Stored without metadata, so the key is only the start of it
+}
+
+// Call a function with every key stored in a volume server
+// Returns an error if the listing was cut short
+func listVolumeKeys(volume string, fn func(k *volumeKey) error) error {
+	resp, err := http.Get(fmt.Sprintf("%v/keys", volume))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.New("response from volume server is not 200 OK")
+	}
+
+	count := 0
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		k := &volumeKey{}
+		err := decoder.Decode(k)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		count++
+		err = fn(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.Trailer.Get("X-Tdkvs-Count") != fmt.Sprintf("%v", count) {
+		return errors.New("listing of keys from volume server was cut short")
+	}
+	return nil
+}
+
+// Garbage collection in a volume server, as reported by it
+type volumeCollection struct {
+	Scanned int   `json:"scanned"`
+	Deleted int   `json:"deleted"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Ask a volume server to delete the values that are not referenced and are
+// older than the grace period, in seconds
+// The referenced keys are written to the request body by the given function,
+// which returns the amount of keys it wrote
+func gcInVolume(volume string, grace int, write func(w io.Writer) (int, error)) (*volumeCollection, error) {
+	body, writer := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%v/gc?grace=%v", volume, grace), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Trailer = http.Header{"X-Tdkvs-Count": nil}
+
+	// The trailer is sent once the body is written, so the volume server
+	// can tell a complete list from one that was cut short
+	go func() {
+		count, err := write(writer)
+		if err == nil {
+			req.Trailer.Set("X-Tdkvs-Count", fmt.Sprintf("%v", count))
+		}
+		writer.CloseWithError(err)
+	}()
+
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New("response from volume server is not 200 OK")
+	}
+
+	result := &volumeCollection{}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
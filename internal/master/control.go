@@ -0,0 +1,228 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// States of a rebalance reported by the admin API
+const (
+	rebalanceIdle       = "idle"
+	rebalanceRunning    = "running"
+	rebalancePaused     = "paused"
+	rebalanceCancelling = "cancelling"
+	rebalanceCancelled  = "cancelled"
+	rebalanceFailed     = "failed"
+	rebalanceDone       = "done"
+)
+
+// Returned by a rebalance that was cancelled
+var errRebalanceCancelled = errors.New("rebalance was cancelled")
+
+// Progress and controls of a rebalance
+type rebalanceControl struct {
+	mu      sync.Mutex
+	resumed *sync.Cond // Signaled when the rebalance is resumed or cancelled
+
+	state     string
+	job       rebalanceJob // Copy of the persisted progress
+	remaining int          // Amount of keys left to scan
+	err       error        // Error the rebalance finished with
+
+	started      time.Time     // Time this run of the rebalance started
+	startScanned int           // Amount of keys scanned before this run
+	pausedAt     time.Time     // Time the rebalance was paused
+	pausedFor    time.Duration // Total time the rebalance was paused in this run
+}
+
+// Progress of a rebalance as reported by the admin API
+type rebalanceStatus struct {
+	State      string       `json:"state"`
+	NumVolumes int          `json:"num_volumes,omitempty"`
+	Replicas   int          `json:"replicas,omitempty"`
+	Retiring   *retirement  `json:"retiring,omitempty"`
+	Replacing  *replacement `json:"replacing,omitempty"`
+	Scanned    int          `json:"scanned"`
+	Moved      int          `json:"moved"`
+	Failed     int          `json:"failed"`
+	Remaining  int          `json:"remaining"`
+	ETASeconds float64      `json:"eta_seconds"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// Create the control of a rebalance that is about to start
+func newRebalanceControl() *rebalanceControl {
+	ctl := &rebalanceControl{
+		state:   rebalanceRunning,
+		started: time.Now(),
+	}
+	ctl.resumed = sync.NewCond(&ctl.mu)
+	return ctl
+}
+
+// Wait while the rebalance is paused
+// Returns false if the rebalance was cancelled and should stop
+func (ctl *rebalanceControl) proceed() bool {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	for ctl.state == rebalancePaused {
+		ctl.resumed.Wait()
+	}
+	return ctl.state != rebalanceCancelling
+}
+
+// Check if the rebalance was cancelled
+func (ctl *rebalanceControl) cancelled() bool {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	return ctl.state == rebalanceCancelling
+}
+
+// Update the progress of the rebalance
+func (ctl *rebalanceControl) update(job *rebalanceJob, remaining int) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	if ctl.job.NumVolumes == 0 {
+		ctl.startScanned = job.Scanned
+	}
+	ctl.job = *job
+	ctl.remaining = remaining
+}
+
+// Mark the rebalance as finished with an error, if any
+func (ctl *rebalanceControl) finish(err error) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	ctl.err = err
+	switch {
+	case err == nil:
+		ctl.state = rebalanceDone
+		ctl.remaining = 0
+	case errors.Is(err, errRebalanceCancelled):
+		ctl.state = rebalanceCancelled
+	default:
+		ctl.state = rebalanceFailed
+	}
+	ctl.resumed.Broadcast()
+}
+
+// Pause the rebalance after the keys that are being moved
+func (ctl *rebalanceControl) pause() error {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	if ctl.state != rebalanceRunning {
+		return fmt.Errorf("cannot pause a rebalance that is %v", ctl.state)
+	}
+	ctl.state = rebalancePaused
+	ctl.pausedAt = time.Now()
+	return nil
+}
+
+// Resume a paused rebalance
+func (ctl *rebalanceControl) resume() error {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	if ctl.state != rebalancePaused {
+		return fmt.Errorf("cannot resume a rebalance that is %v", ctl.state)
+	}
+	ctl.state = rebalanceRunning
+	ctl.pausedFor += time.Since(ctl.pausedAt)
+	ctl.resumed.Broadcast()
+	return nil
+}
+
+// Cancel the rebalance after the keys that are being moved, so every key
+// stays in the volume servers its metakey points to
+func (ctl *rebalanceControl) cancel() error {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	if ctl.state != rebalanceRunning && ctl.state != rebalancePaused {
+		return fmt.Errorf("cannot cancel a rebalance that is %v", ctl.state)
+	}
+	if ctl.state == rebalancePaused {
+		ctl.pausedFor += time.Since(ctl.pausedAt)
+	}
+	ctl.state = rebalanceCancelling
+	ctl.resumed.Broadcast()
+	return nil
+}
+
+// Report the progress of the rebalance
+func (ctl *rebalanceControl) status() rebalanceStatus {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	status := rebalanceStatus{
+		State:      ctl.state,
+		NumVolumes: ctl.job.NumVolumes,
+		Replicas:   ctl.job.Replicas,
+		Retiring:   ctl.job.Retiring,
+		Replacing:  ctl.job.Replacing,
+		Scanned:    ctl.job.Scanned,
+		Moved:      ctl.job.Moved,
+		Failed:     ctl.job.Failed,
+		Remaining:  ctl.remaining,
+	}
+	if ctl.err != nil {
+		status.Error = ctl.err.Error()
+	}
+
+	// Estimate the time left from the rate of keys scanned in this run,
+	// not counting the time the rebalance was paused
+	active := time.Since(ctl.started) - ctl.pausedFor
+	if ctl.state == rebalancePaused {
+		active -= time.Since(ctl.pausedAt)
+	}
+	scanned := ctl.job.Scanned - ctl.startScanned
+	if scanned > 0 && active > 0 {
+		status.ETASeconds = active.Seconds() / float64(scanned) * float64(ctl.remaining)
+	}
+
+	return status
+}
+
+// Return the control of the current or last rebalance, or nil if there
+// wasn't any
+func (c *context) rebalanceControl() *rebalanceControl {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.control
+}
+
+// Handle reporting the progress of the rebalance
+func rebalanceStatusHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	status := rebalanceStatus{State: rebalanceIdle}
+	if ctl := c.rebalanceControl(); ctl != nil {
+		status = ctl.status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Handle pausing, resuming or cancelling the rebalance
+func rebalanceActionHandler(w http.ResponseWriter, r *http.Request, c *context, action func(ctl *rebalanceControl) error) {
+	ctl := c.rebalanceControl()
+	if ctl == nil {
+		http.Error(w, "No rebalance is running", http.StatusConflict)
+		return
+	}
+
+	err := action(ctl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	fmt.Fprintf(w, "ok")
+}
@@ -0,0 +1,306 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+)
+
+// Retirement of a bucket of a volume server, i.e. when it is decommissioned
+// or its weight is lowered
+// The bucket is copied and remapped to a spare volume server. Without a
+// spare, the bucket is remapped to the volume server of the last bucket,
+// and the last bucket is drained and removed, since jump consistent hash can
+// only remove the last bucket cleanly. Either way only the keys of the
+// retired bucket and of the last bucket are touched
+type retirement struct {
+	Bucket   uint32 `json:"bucket"`       // Retired bucket
+	Volume   string `json:"volume"`       // Url of the volume server of the retired bucket
+	To       string `json:"to,omitempty"` // Url of the volume server that takes over the bucket. Empty if the retired bucket is the last one
+	Drain    bool   `json:"drain"`        // Whether the last bucket is drained and removed
+	Remapped bool   `json:"remapped"`     // Whether the bucket was copied and points to its new volume server
+	Weight   int    `json:"weight"`       // Amount of buckets the volume server should have once all of them are retired
+}
+
+// Plan the retirement of the volume server of a bucket
+func newRetirement(buckets []string, bucket int, spare string) *retirement {
+	r := &retirement{
+		Bucket: uint32(bucket),
+		Volume: buckets[bucket],
+		To:     spare,
+	}
+
+	if spare == "" {
+		r.Drain = true
+		last := len(buckets) - 1
+		if bucket != last {
+			r.To = buckets[last]
+		}
+	}
+
+	// Nothing to copy if the bucket is the last one or both buckets are in the
+	// same volume server. The last bucket is drained right away
+	if r.To == "" || r.To == r.Volume {
+		r.Remapped = true
+	}
+	return r
+}
+
+// Check if the retired bucket is being copied to its new volume server
+func (r *retirement) remapping() bool {
+	return r != nil && !r.Remapped
+}
+
+// Check if the last bucket is being drained
+func (r *retirement) draining() bool {
+	return r != nil && r.Drain && r.Remapped
+}
+
+// Check if two retirements retire the same volume server in the same way
+func (r *retirement) matches(other *retirement) bool {
+	if r == nil || other == nil {
+		return r == nil && other == nil
+	}
+	return r.Bucket == other.Bucket && r.Volume == other.Volume && r.To == other.To && r.Drain == other.Drain
+}
+
+// Change the retirement in progress
+// Requests that are choosing buckets are waited for, so none of them writes
+// a key to a bucket that has just started being drained or remapped
+func (c *context) setRetiring(r *retirement) {
+	c.membership.Lock()
+	defer c.membership.Unlock()
+
+	c.mu.Lock()
+	c.retiring = r
+	c.mu.Unlock()
+}
+
+// Restore the goal of a retirement that was interrupted, which takes
+// precedence over the weights in the config
+func (c *context) restoreRetirement(r *retirement) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !r.Drain {
+		// The spare gets all the buckets of the volume server it replaces
+		c.spares[r.Volume] = r.To
+		c.weights[r.To] = countVolume(c.buckets, r.To) + countVolume(c.buckets, r.Volume) - r.Weight
+	}
+	c.weights[r.Volume] = r.Weight
+}
+
+// Stop retiring the buckets of a volume server, keeping the ones it has
+func (c *context) abandonRetirement(r *retirement) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.weights[r.Volume] = countVolume(c.buckets, r.Volume)
+	if !r.Drain {
+		c.weights[r.To] = countVolume(c.buckets, r.To)
+	}
+	delete(c.spares, r.Volume)
+}
+
+// Check that the volume server of a bucket can be decommissioned
+func validateRetirement(c *context, index int, spare string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if index < 0 || index >= len(c.buckets) {
+		return fmt.Errorf("volume %v is not in the range [0, %v)", index, len(c.buckets))
+	}
+
+	if spare != "" {
+		if containsVolume(c.buckets, spare) {
+			return fmt.Errorf("volume server %v already exists", spare)
+		}
+		return nil
+	}
+
+	// Volume servers that keep their buckets
+	remaining := 0
+	for url, weight := range c.weights {
+		if url != c.buckets[index] && weight > 0 {
+			remaining++
+		}
+	}
+
+	if remaining == 0 {
+		return errors.New("you cannot delete the last volume server")
+	}
+
+	if remaining < c.config.Replicas {
+		return fmt.Errorf("you cannot have less volume servers than replicas (%v)", c.config.Replicas)
+	}
+
+	return nil
+}
+
+// Start decommissioning the volume server of a bucket
+// All of its buckets are retired, and taken over by the spare if one is given
+// Returns the first retirement
+func (c *context) decommission(index int, spare string) *retirement {
+	c.mu.Lock()
+	url := c.buckets[index]
+	if spare != "" {
+		c.spares[url] = spare
+		c.weights[spare] = countVolume(c.buckets, url)
+	}
+	c.weights[url] = 0
+	c.mu.Unlock()
+
+	return c.nextRetirement()
+}
+
+// Handle decommissioning a volume server at runtime
+// If a spare volume server is given with the `spare` query parameter, it
+// takes over the buckets of the decommissioned one. Keys are moved in the
+// background while the master server keeps serving requests
+func decommissionVolumeHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil {
+		http.Error(w, "Invalid volume server index", http.StatusBadRequest)
+		return
+	}
+	spare := strings.TrimSuffix(strings.TrimSpace(r.URL.Query().Get("spare")), "/")
+
+	c.mu.RLock()
+	retiring := c.retiring
+	c.mu.RUnlock()
+
+	if retiring == nil {
+		err = validateRetirement(c, index, spare)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the spare volume server is up and is the one we expect before
+		// copying keys to it
+		if spare != "" {
+			err = c.verifyVolume(spare)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+		}
+	}
+
+	c.mu.Lock()
+	if c.rebalancing {
+		c.mu.Unlock()
+		http.Error(w, "A rebalance is already running", http.StatusConflict)
+		return
+	}
+
+	if c.retiring != retiring {
+		c.mu.Unlock()
+		http.Error(w, "A decommission was started meanwhile", http.StatusConflict)
+		return
+	}
+
+	// A failed retirement can be retried, but no other one can be started
+	// until it is done
+	if retiring != nil && (index < 0 || index >= len(c.buckets) || c.buckets[index] != retiring.Volume) && retiring.Bucket != uint32(index) {
+		c.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Bucket %v of volume server %v is being retired. Retry its decommission first", retiring.Bucket, retiring.Volume), http.StatusConflict)
+		return
+	}
+	c.rebalancing = true
+	c.mu.Unlock()
+
+	if retiring == nil {
+		retiring = c.decommission(index, spare)
+		c.setRetiring(retiring)
+	}
+
+	log.Printf("Decommissioning volume server %v", retiring.Volume)
+	go runRebalance(c)
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "decommissioning volume server %v", retiring.Volume)
+}
+
+// Copy the keys of the retired bucket to the volume server that takes it
+// over, and point the bucket to it
+// Writes go to both volume servers meanwhile, so keys that were copied
+// stay up to date. The retired volume server is left untouched
+func remapBucket(c *context, ctl *rebalanceControl, job *rebalanceJob) error {
+	r := job.Retiring
+	log.Printf("Copying bucket %v from volume server %v to %v...", r.Bucket, r.Volume, r.To)
+
+	err := scanKeys(c, ctl, job, func(c *context, key string) (bool, error) {
+		return remapKey(c, key, r)
+	})
+	if err != nil {
+		return err
+	}
+
+	buckets := append([]string{}, c.volumes()...)
+	buckets[r.Bucket] = r.To
+
+	remapped := *r
+	remapped.Remapped = true
+	job.Retiring = &remapped
+	job.LastKey = ""
+
+	// Requests are paused while the bucket is switched, so none of them writes
+	// to the retired volume server only
+	c.membership.Lock()
+	defer c.membership.Unlock()
+
+	err = c.db.Update(func(txn kvTxn) error {
+		err := putBuckets(txn, buckets)
+		if err != nil {
+			return err
+		}
+		return putRebalanceJob(txn, job)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.buckets = buckets
+	c.retiring = job.Retiring
+	c.mu.Unlock()
+
+	log.Printf("Bucket %v now points to volume server %v", r.Bucket, r.To)
+	return nil
+}
+
+// Copy a key of the retired bucket to the volume server that takes it over
+// Returns whether the key was copied
+func remapKey(c *context, key string, r *retirement) (bool, error) {
+	c.membership.RLock()
+	defer c.membership.RUnlock()
+
+	unlock := c.locks.lock(key)
+	defer unlock()
+
+	m, err := lookupMetakey(c, key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !m.hasVolume(r.Bucket) {
+		return false, nil
+	}
+
+	hash := c.hash(key)
+	_, err = copyValue(c, key, hash, []string{r.Volume}, r.To, hash)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,351 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Value stored in a volume server
+type storedValue struct {
+	key  string
+	hash uint64
+}
+
+// Value that a metakey, or no metakey, refers to
+type fsckValue struct {
+	key      string
+	hash     uint64
+	bucket   int    // Bucket of the replica. -1 for orphans
+	volume   string // Url of the volume server that holds, or should hold, the value
+	repaired bool
+}
+
+// Key whose replicas are not in the buckets placement chooses for it
+type misplacedKey struct {
+	key      string
+	buckets  []uint32
+	chosen   []uint32
+	repaired bool
+}
+
+// Inconsistencies between the metakeys and the values in the volume
+// servers
+type fsckReport struct {
+	scanned   int             // Amount of metakeys checked
+	values    int             // Amount of values listed by the volume servers
+	missing   []*fsckValue    // Replicas that metakeys point to but volume servers don't have
+	lost      []*fsckValue    // Keys that no volume server has a value of. One entry per key
+	orphans   []*fsckValue    // Values that no metakey points to
+	misplaced []*misplacedKey // Keys whose buckets are not the ones placement chooses
+	unknown   int             // Values stored without metadata whose key could not be told
+}
+
+// Check every metakey against the values in the volume servers, and
+// repair the inconsistencies if asked to
+// Missing replicas are copied from any volume server that has the value,
+// metakeys of keys that no volume server has are deleted, orphaned values
+// are deleted, and misplaced keys are moved to the buckets placement
+// chooses. The master server must be stopped, which the lock on its
+// BadgerDB enforces, so no write is in flight
+func runFsck(c *context, repair bool) (*fsckReport, error) {
+	job, err := getRebalanceJob(c.db)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := countKeysWithPrefix(c.db, migrationPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if job != nil || pending > 0 {
+		return nil, errors.New("a rebalance or a move of keys was interrupted. Start the master server to finish it before running fsck")
+	}
+
+	report := &fsckReport{}
+	table := c.volumes()
+
+	// Values in every volume server, and whether a metakey points to them
+	// Values stored without metadata whose key is longer than the start of
+	// it in their file name are kept apart, and matched by hash and the start
+	// of the key
+	stored := make(map[string]map[storedValue]bool)
+	partials := make(map[string]map[storedValue]bool)
+	for _, url := range table {
+		if stored[url] != nil {
+			continue
+		}
+
+		values := make(map[storedValue]bool)
+		partialValues := make(map[storedValue]bool)
+		err := listVolumeKeys(url, func(k *volumeKey) error {
+			report.values++
+			hash, err := strconv.ParseUint(k.Hash, 10, 64)
+			if err != nil {
+				report.unknown++
+				return nil
+			}
+			if k.Partial && c.hash(k.Key) != hash {
+				partialValues[storedValue{k.Key, hash}] = false
+				return nil
+			}
+			values[storedValue{k.Key, hash}] = false
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not list the keys of volume server %v: %w", url, err)
+		}
+		stored[url] = values
+		partials[url] = partialValues
+	}
+
+	// Find the value of a key in a volume server, and mark it as referenced
+	// if asked to
+	find := func(url string, v storedValue, reference bool) bool {
+		if _, ok := stored[url][v]; ok {
+			if reference {
+				stored[url][v] = true
+			}
+			return true
+		}
+		for p := range partials[url] {
+			if p.hash == v.hash && strings.HasPrefix(v.key, p.key) {
+				if reference {
+					partials[url][p] = true
+				}
+				return true
+			}
+		}
+		return false
+	}
+
+	// Volume servers that hold a value
+	holders := func(v storedValue) []string {
+		urls := []string{}
+		for url := range stored {
+			if find(url, v, false) {
+				urls = append(urls, url)
+			}
+		}
+		return urls
+	}
+
+	last := ""
+	for {
+		entries, err := nextKeys(c.db, last, rebalanceBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			report.scanned++
+			hints, err := lookupHints(c.db, entry.key)
+			if err != nil {
+				return nil, err
+			}
+
+			hash := c.hash(entry.key)
+			missing := []*fsckValue{}
+			found := false
+			for _, bucket := range entry.m.Volumes {
+				v := &fsckValue{key: entry.key, hash: hash, bucket: int(bucket), volume: "(not in config)"}
+				if int(bucket) < len(table) {
+					v.volume = table[bucket]
+				}
+				if h := hintFor(hints, bucket); h != nil {
+					v.volume = h.Fallback
+					v.hash = h.Hash
+				}
+
+				if find(v.volume, storedValue{v.key, v.hash}, true) {
+					found = true
+					continue
+				}
+				missing = append(missing, v)
+			}
+
+			if !found && len(holders(storedValue{entry.key, hash})) == 0 {
+				report.lost = append(report.lost, &fsckValue{key: entry.key, hash: hash, bucket: -1})
+				continue
+			}
+			report.missing = append(report.missing, missing...)
+
+			_, chosen := c.chooseVolumes(entry.key)
+			if !sameVolumes(entry.m.Volumes, chosen) {
+				report.misplaced = append(report.misplaced, &misplacedKey{key: entry.key, buckets: entry.m.Volumes, chosen: chosen})
+			}
+		}
+
+		last = entries[len(entries)-1].key
+	}
+
+	for url, values := range stored {
+		for value, referenced := range values {
+			if !referenced {
+				report.orphans = append(report.orphans, &fsckValue{key: value.key, hash: value.hash, bucket: -1, volume: url})
+			}
+		}
+	}
+	// Values stored without metadata that no metakey matches may belong to
+	// any key that starts like theirs, so they are not taken for orphans
+	for _, values := range partials {
+		for _, referenced := range values {
+			if !referenced {
+				report.unknown++
+			}
+		}
+	}
+	sort.Slice(report.orphans, func(i, j int) bool {
+		a, b := report.orphans[i], report.orphans[j]
+		if a.volume != b.volume {
+			return a.volume < b.volume
+		}
+		return a.key < b.key
+	})
+
+	if !repair {
+		return report, nil
+	}
+
+	// Orphans may be the only copy of a missing replica, so they are deleted
+	// after missing replicas are copied, and misplaced keys are moved last,
+	// so their new replicas are not taken for orphans
+	for _, v := range report.missing {
+		hash := v.hash
+		sources := holders(storedValue{v.key, hash})
+		if len(sources) == 0 {
+			hash = c.hash(v.key)
+			sources = holders(storedValue{v.key, hash})
+		}
+		_, err := copyValue(c, v.key, hash, sources, v.volume, v.hash)
+		if err != nil {
+			log.Printf("Could not copy key \"%v\" to volume server %v: %v", v.key, v.volume, err)
+			continue
+		}
+		v.repaired = true
+	}
+
+	for _, v := range report.lost {
+		err := c.db.Update(func(txn kvTxn) error {
+			err := txn.Delete([]byte(v.key))
+			if err != nil {
+				return err
+			}
+			return putHints(txn, v.key, nil)
+		})
+		if err != nil {
+			log.Printf("Could not delete metakey of key \"%v\": %v", v.key, err)
+			continue
+		}
+		v.repaired = true
+	}
+
+	for _, v := range report.orphans {
+		err := deleteFromVolume(v.volume, v.key, v.hash)
+		if err != nil {
+			log.Printf("Could not delete orphaned key \"%v\" from volume server %v: %v", v.key, v.volume, err)
+			continue
+		}
+		v.repaired = true
+	}
+
+	for _, k := range report.misplaced {
+		m, err := lookupMetakey(c, k.key)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			continue
+		}
+		if err == nil {
+			err = migrateKey(c, k.key, c.hash(k.key), m.Volumes, k.chosen)
+		}
+		if err != nil {
+			log.Printf("Could not move key \"%v\" to volume servers %v: %v", k.key, k.chosen, err)
+			continue
+		}
+		k.repaired = true
+	}
+
+	return report, nil
+}
+
+// Count the keys in BadgerDB with a prefix
+func countKeysWithPrefix(db *store, prefix string) (int, error) {
+	count := 0
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Print the inconsistencies found by fsck, and whether they were repaired
+func printFsck(w io.Writer, r *fsckReport, repair bool) {
+	fmt.Fprintf(w, "Checked %v keys against %v values in the volume servers\n", r.scanned, r.values)
+	if r.unknown > 0 {
+		fmt.Fprintf(w, "%v values were stored without metadata and their keys could not be told. They were not checked\n", r.unknown)
+	}
+
+	status := func(repaired bool) string {
+		switch {
+		case !repair:
+			return ""
+		case repaired:
+			return "repaired"
+		default:
+			return "failed"
+		}
+	}
+
+	sections := []struct {
+		title  string
+		values []*fsckValue
+	}{
+		{"Missing replicas (in metakeys but not in volume servers)", r.missing},
+		{"Lost keys (no volume server has their value)", r.lost},
+		{"Orphaned values (in volume servers but not in metakeys)", r.orphans},
+	}
+	for _, section := range sections {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "%v: %v\n", section.title, len(section.values))
+		if len(section.values) == 0 {
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "key\thash\tbucket\tvolume server\t\t")
+		for _, v := range section.values {
+			bucket := "-"
+			if v.bucket >= 0 {
+				bucket = fmt.Sprint(v.bucket)
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t\n", v.key, v.hash, bucket, v.volume, status(v.repaired))
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Misplaced keys (not in the buckets placement chooses): %v\n", len(r.misplaced))
+	if len(r.misplaced) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "key\tbuckets\tchosen buckets\t\t")
+		for _, k := range r.misplaced {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t\n", k.key, k.buckets, k.chosen, status(k.repaired))
+		}
+		tw.Flush()
+	}
+}
@@ -0,0 +1,168 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Error of a garbage collection that was not run because keys are being
+// moved between volume servers
+var errGCBusy = errors.New("keys are being moved between volume servers. Garbage is collected once they are done")
+
+// Garbage collection in a volume server as reported by the admin API
+type gcResult struct {
+	Volume string `json:"volume"`
+	*volumeCollection
+	Error string `json:"error,omitempty"`
+}
+
+// Write every key that the metakeys reference in a volume server, one JSON
+// object per line
+// Replicas whose writes were handed off to the volume server are
+// referenced under the hash of their hint
+// Returns the amount of keys that were written
+func writeReferencedKeys(c *context, url string, w io.Writer) (int, error) {
+	// Hints are loaded before the metakeys, so the values of later hand offs
+	// are newer than the grace period
+	hinted, err := listHintedKeys(c.db)
+	if err != nil {
+		return 0, err
+	}
+	fallbacks := make(map[string][]uint64)
+	for _, key := range hinted {
+		hints, err := lookupHints(c.db, key)
+		if err != nil {
+			return 0, err
+		}
+		for _, h := range hints {
+			if h.Fallback == url {
+				fallbacks[key] = append(fallbacks[key], h.Hash)
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	count := 0
+	write := func(key string, hash uint64) error {
+		count++
+		return encoder.Encode(map[string]string{"key": key, "hash": fmt.Sprintf("%v", hash)})
+	}
+
+	last := ""
+	for {
+		entries, err := nextKeys(c.db, last, rebalanceBatchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			hash := c.hash(entry.key)
+			if containsVolume(c.bucketVolumes(entry.m.Volumes), url) {
+				err := write(entry.key, hash)
+				if err != nil {
+					return count, err
+				}
+			}
+			for _, fallbackHash := range fallbacks[entry.key] {
+				err := write(entry.key, fallbackHash)
+				if err != nil {
+					return count, err
+				}
+			}
+		}
+
+		last = entries[len(entries)-1].key
+	}
+	return count, nil
+}
+
+// Delete the values that no metakey references from every volume server
+// Values newer than the grace period are kept, since their metakeys may not
+// be written yet. Nothing is collected while keys are being moved, since
+// their new replicas are not referenced until they are done
+func collectGarbage(c *context) ([]gcResult, error) {
+	c.mu.RLock()
+	rebalancing := c.rebalancing
+	c.mu.RUnlock()
+	pending, err := countKeysWithPrefix(c.db, migrationPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if rebalancing || pending > 0 {
+		return nil, errGCBusy
+	}
+
+	urls := []string{}
+	for _, url := range c.volumes() {
+		if !containsVolume(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+
+	results := []gcResult{}
+	for _, url := range urls {
+		url := url
+		collection, err := gcInVolume(url, c.config.GCGrace, func(w io.Writer) (int, error) {
+			return writeReferencedKeys(c, url, w)
+		})
+		if err != nil {
+			log.Printf("Could not collect garbage in volume server %v: %v", url, err)
+			results = append(results, gcResult{Volume: url, Error: err.Error()})
+			continue
+		}
+		results = append(results, gcResult{Volume: url, volumeCollection: collection})
+	}
+	return results, nil
+}
+
+// Collect garbage in the volume servers periodically until the master
+// server stops
+func monitorGC(c *context) {
+	for {
+		time.Sleep(time.Duration(c.config.GCInterval) * time.Second)
+
+		results, err := collectGarbage(c)
+		if errors.Is(err, errGCBusy) {
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		deleted := 0
+		for _, result := range results {
+			if result.volumeCollection != nil {
+				deleted += result.Deleted
+			}
+		}
+		if deleted > 0 {
+			log.Printf("Collected %v unreferenced values", deleted)
+		}
+	}
+}
+
+// Handle collecting garbage in the volume servers now
+func gcHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	results, err := collectGarbage(c)
+	if errors.Is(err, errGCBusy) {
+		http.Error(w, "Keys are being moved between volume servers. Collect garbage once they are done", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "An error occurred while collecting garbage", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
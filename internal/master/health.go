@@ -0,0 +1,218 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Health states of volume servers
+const (
+	healthUnknown = "unknown" // Never sent a heartbeat
+	healthHealthy = "healthy" // Sent a heartbeat recently
+	healthSuspect = "suspect" // Missed some heartbeats
+	healthDown    = "down"    // Missed heartbeats for too long
+)
+
+// Heartbeat a volume server sends to the master server
+type heartbeat struct {
+	URL       string `json:"url"`
+	VolumeID  string `json:"volume_id"`
+	ClusterID string `json:"cluster_id"`
+	DiskTotal uint64 `json:"disk_total"` // Size of the disk of the storage directory in bytes
+	DiskFree  uint64 `json:"disk_free"`  // Free bytes on the disk of the storage directory
+}
+
+// Health of a volume server as reported by the admin API
+type volumeHealth struct {
+	URL       string     `json:"url"`
+	State     string     `json:"state"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"` // Time of the last heartbeat. Empty if it never sent one
+	DiskTotal uint64     `json:"disk_total"`
+	DiskFree  uint64     `json:"disk_free"`
+	Member    bool       `json:"member"` // Whether the volume server holds buckets
+}
+
+// Tracks the heartbeats of volume servers
+// Volume servers that never sent a heartbeat, i.e. because they are not
+// configured with a master server, are in the unknown state and are treated
+// as healthy
+type healthTracker struct {
+	suspectAfter time.Duration // Time without heartbeats after which a volume server is suspect
+	downAfter    time.Duration // Time without heartbeats after which a volume server is down
+	now          func() time.Time
+
+	mu     sync.Mutex
+	beats  map[string]heartbeat // Last heartbeat of every volume server
+	seen   map[string]time.Time // Time of the last heartbeat of every volume server
+	states map[string]string    // Last state that was logged for every volume server
+}
+
+// Create a health tracker
+func newHealthTracker(suspectAfter time.Duration, downAfter time.Duration) *healthTracker {
+	return &healthTracker{
+		suspectAfter: suspectAfter,
+		downAfter:    downAfter,
+		now:          time.Now,
+		beats:        make(map[string]heartbeat),
+		seen:         make(map[string]time.Time),
+		states:       make(map[string]string),
+	}
+}
+
+// Record a heartbeat
+func (h *healthTracker) beat(hb heartbeat) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.beats[hb.URL] = hb
+	h.seen[hb.URL] = h.now()
+}
+
+// Return the state of a volume server
+func (h *healthTracker) state(url string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stateLocked(url)
+}
+
+func (h *healthTracker) stateLocked(url string) string {
+	seen, ok := h.seen[url]
+	if !ok {
+		return healthUnknown
+	}
+
+	elapsed := h.now().Sub(seen)
+	switch {
+	case elapsed >= h.downAfter:
+		return healthDown
+	case elapsed >= h.suspectAfter:
+		return healthSuspect
+	default:
+		return healthHealthy
+	}
+}
+
+// Order buckets so the ones of healthy volume servers come first, then
+// suspect ones and then the ones that are down, keeping their order otherwise
+func (h *healthTracker) order(urls []string, volumes []uint32) []uint32 {
+	rank := map[string]int{healthHealthy: 0, healthUnknown: 0, healthSuspect: 1, healthDown: 2}
+
+	h.mu.Lock()
+	ranks := make(map[uint32]int)
+	for _, numVolume := range volumes {
+		ranks[numVolume] = rank[h.stateLocked(urls[numVolume])]
+	}
+	h.mu.Unlock()
+
+	ordered := append([]uint32{}, volumes...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ranks[ordered[i]] < ranks[ordered[j]] })
+	return ordered
+}
+
+// Log volume servers whose state changed since the last check
+func (h *healthTracker) check() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for url := range h.seen {
+		state := h.stateLocked(url)
+		if h.states[url] == state {
+			continue
+		}
+
+		if h.states[url] == "" {
+			log.Printf("Volume server %v is %v", url, state)
+		} else {
+			log.Printf("Volume server %v is %v (was %v)", url, state, h.states[url])
+		}
+		h.states[url] = state
+	}
+}
+
+// Return the health of the given volume servers and of every volume server
+// that sent a heartbeat, sorted by url
+func (h *healthTracker) status(members []string) []volumeHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	urls := append([]string{}, members...)
+	for url := range h.seen {
+		if !containsVolume(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+
+	health := []volumeHealth{}
+	for _, url := range urls {
+		hb := h.beats[url]
+		var lastSeen *time.Time
+		if seen, ok := h.seen[url]; ok {
+			lastSeen = &seen
+		}
+		health = append(health, volumeHealth{
+			URL:       url,
+			State:     h.stateLocked(url),
+			LastSeen:  lastSeen,
+			DiskTotal: hb.DiskTotal,
+			DiskFree:  hb.DiskFree,
+			Member:    containsVolume(members, url),
+		})
+	}
+	return health
+}
+
+// Log changes in the health of volume servers until the master server stops
+func monitorHealth(c *context) {
+	for {
+		time.Sleep(time.Second)
+		c.health.check()
+	}
+}
+
+// Handle a heartbeat of a volume server
+// The first heartbeat of a volume server registers it. A volume server whose
+// identity is not the one the master server knows is verified again, and
+// its heartbeat is refused if it is not the volume server we expect
+func heartbeatHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	hb := heartbeat{}
+	err := json.NewDecoder(r.Body).Decode(&hb)
+	if err != nil || hb.URL == "" {
+		http.Error(w, "Invalid heartbeat", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.RLock()
+	known := hb.ClusterID == c.clusterID && c.identities[hb.URL] == hb.VolumeID
+	c.mu.RUnlock()
+
+	if !known {
+		err := c.verifyVolume(hb.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			log.Println(err)
+			return
+		}
+	}
+
+	c.health.beat(hb)
+	fmt.Fprintf(w, "ok")
+}
+
+// Handle listing the health of volume servers
+func healthHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	members := []string{}
+	for _, url := range c.volumes() {
+		if !containsVolume(members, url) {
+			members = append(members, url)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.health.status(members))
+}
@@ -0,0 +1,357 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Prefix of the hints of keys whose writes were handed off
+const hintPrefix = "_meta_hint_"
+
+// Time between attempts to replay hints to their volume servers
+const hintReplayInterval = 5 * time.Second
+
+// Write of a key that was handed off to a fallback volume server because
+// the volume server of one of its buckets could not be reached
+// The value is replayed to the volume server of the bucket once it recovers
+type hint struct {
+	Bucket   uint32 `json:"bucket"`   // Bucket of the replica that was handed off
+	Volume   string `json:"volume"`   // Url of the volume server of the bucket when the write was handed off
+	Fallback string `json:"fallback"` // Url of the volume server that holds the value meanwhile
+	Hash     uint64 `json:"hash"`     // Hash the value is stored under in the fallback volume server
+}
+
+// Hint of a key as reported by the admin API
+type keyHint struct {
+	Key string `json:"key"`
+	hint
+}
+
+// Return the hint of a bucket, or nil if its write was not handed off
+func hintFor(hints []hint, bucket uint32) *hint {
+	for i := range hints {
+		if hints[i].Bucket == bucket {
+			return &hints[i]
+		}
+	}
+	return nil
+}
+
+// Retrieve the hints of a key
+// Returns no hints if none of the writes of the key were handed off
+func getHints(txn kvTxn, key string) ([]hint, error) {
+	item, err := txn.Get([]byte(hintPrefix + key))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hints := []hint{}
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &hints)
+	})
+	return hints, err
+}
+
+// Retrieve the hints of a key in its own transaction
+func lookupHints(db *store, key string) ([]hint, error) {
+	var hints []hint
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		hints, err = getHints(txn, key)
+		return err
+	})
+	return hints, err
+}
+
+// Set the hints of a key in a transaction, or delete them if there are none
+func putHints(txn kvTxn, key string, hints []hint) error {
+	if len(hints) == 0 {
+		return txn.Delete([]byte(hintPrefix + key))
+	}
+
+	value, err := json.Marshal(hints)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(hintPrefix+key), value)
+}
+
+// List the keys that have hints
+func listHintedKeys(db *store) ([]string, error) {
+	keys := []string{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(hintPrefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, strings.TrimPrefix(string(it.Item().Key()), hintPrefix))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Return the volume servers holding the given buckets of a key, without
+// duplicates. Buckets whose write was handed off are read from their
+// fallback volume servers, since their own volume servers may not have the
+// value yet
+func (c *context) readVolumes(key string, buckets []uint32) ([]string, error) {
+	hints, err := lookupHints(c.db, key)
+	if err != nil {
+		return nil, err
+	}
+
+	table := c.volumes()
+	urls := []string{}
+	for _, bucket := range buckets {
+		url := table[bucket]
+		if h := hintFor(hints, bucket); h != nil {
+			url = h.Fallback
+		}
+		if !containsVolume(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
+// Return the volume servers that writes can be handed off to, leaving out
+// the given ones and the ones that are suspect, down or being emptied
+// Volume servers that sent heartbeats recently come first
+func (c *context) fallbackVolumes(exclude []string) []string {
+	rank := map[string]int{healthHealthy: 0, healthUnknown: 1}
+
+	c.mu.RLock()
+	urls := []string{}
+	for _, url := range c.buckets {
+		if containsVolume(exclude, url) || containsVolume(urls, url) || c.weights[url] == 0 {
+			continue
+		}
+		urls = append(urls, url)
+	}
+	c.mu.RUnlock()
+
+	fallbacks := []string{}
+	ranks := make(map[string]int)
+	for _, url := range urls {
+		state := c.health.state(url)
+		if state == healthSuspect || state == healthDown {
+			continue
+		}
+		ranks[url] = rank[state]
+		fallbacks = append(fallbacks, url)
+	}
+	sort.SliceStable(fallbacks, func(i, j int) bool { return ranks[fallbacks[i]] < ranks[fallbacks[j]] })
+	return fallbacks
+}
+
+// Write the replicas of a key that could not be written to fallback
+// volume servers
+// A fallback volume server never holds another replica of the key, nor
+// the value of another bucket of it, nor a value of the key that was
+// handed off before, so handed off values can be deleted if the write fails
+// Returns the hints of the replicas that were handed off
+func handOff(c *context, key string, hash uint64, data []byte, buckets []uint32, failed []uint32) []hint {
+	table := c.volumes()
+	exclude := c.writeVolumes(buckets)
+
+	previous, err := lookupHints(c.db, key)
+	if err != nil {
+		log.Printf("Could not hand off key \"%v\": %v", key, err)
+		return []hint{}
+	}
+	for _, h := range previous {
+		exclude = append(exclude, h.Fallback)
+	}
+
+	hints := []hint{}
+	for _, bucket := range failed {
+		handedOff := false
+		for _, fallback := range c.fallbackVolumes(exclude) {
+			err := setInVolume(fallback, key, hash, data)
+			if err != nil {
+				log.Printf("Could not hand off key \"%v\" to volume server %v: %v", key, fallback, err)
+				continue
+			}
+
+			hints = append(hints, hint{Bucket: bucket, Volume: table[bucket], Fallback: fallback, Hash: hash})
+			exclude = append(exclude, fallback)
+			handedOff = true
+			break
+		}
+
+		if !handedOff {
+			log.Printf("No volume server could take the replica of key \"%v\" in bucket %v", key, bucket)
+		}
+	}
+	return hints
+}
+
+// Delete the values that fallback volume servers hold for hints that are
+// no longer needed
+// Fallback volume servers that still hold the key for another reason are
+// left untouched
+func deleteHandedOff(key string, hints []hint, keep []string) {
+	for _, h := range hints {
+		if containsVolume(keep, h.Fallback) {
+			continue
+		}
+
+		err := deleteFromVolume(h.Fallback, key, h.Hash)
+		if err != nil {
+			log.Printf("Could not delete handed off key \"%v\" from volume server %v: %v", key, h.Fallback, err)
+		}
+	}
+}
+
+// Replay the hints of a key to the volume servers of their buckets
+// Hints of buckets that no longer hold the key are dropped. Hints whose
+// volume server is suspect, down or unreachable are kept for the next
+// attempt
+// Returns the number of hints that were replayed
+func replayKey(c *context, key string) (int, error) {
+	c.membership.RLock()
+	defer c.membership.RUnlock()
+
+	unlock := c.locks.lock(key)
+	defer unlock()
+
+	hints, err := lookupHints(c.db, key)
+	if err != nil || len(hints) == 0 {
+		return 0, err
+	}
+
+	m, err := lookupMetakey(c, key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		m = &metakey{}
+	} else if err != nil {
+		return 0, err
+	}
+
+	table := c.volumes()
+	current := c.writeVolumes(m.Volumes)
+	hash := c.hash(key)
+
+	replayed := 0
+	remaining := []hint{}
+	done := []hint{}
+	for _, h := range hints {
+		if !m.hasVolume(h.Bucket) || int(h.Bucket) >= len(table) {
+			done = append(done, h)
+			continue
+		}
+
+		destination := table[h.Bucket]
+		state := c.health.state(destination)
+		if state == healthSuspect || state == healthDown {
+			remaining = append(remaining, h)
+			continue
+		}
+
+		for _, url := range c.writeVolumes([]uint32{h.Bucket}) {
+			_, err = copyValue(c, key, h.Hash, []string{h.Fallback}, url, hash)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			remaining = append(remaining, h)
+			continue
+		}
+
+		log.Printf("Replayed key \"%v\" from volume server %v to volume server %v", key, h.Fallback, destination)
+		done = append(done, h)
+		replayed++
+	}
+
+	if len(done) == 0 {
+		return 0, nil
+	}
+
+	err = c.db.Update(func(txn kvTxn) error {
+		return putHints(txn, key, remaining)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	keep := append([]string{}, current...)
+	for _, h := range remaining {
+		keep = append(keep, h.Fallback)
+	}
+	deleteHandedOff(key, done, keep)
+	return replayed, nil
+}
+
+// Replay the hints of every key
+// Returns the number of hints that were replayed
+func replayHints(c *context) (int, error) {
+	keys, err := listHintedKeys(c.db)
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, key := range keys {
+		n, err := replayKey(c, key)
+		if err != nil {
+			log.Printf("Could not replay hints of key \"%v\": %v", key, err)
+			continue
+		}
+		replayed += n
+	}
+	return replayed, nil
+}
+
+// Replay hints to volume servers that recovered until the master server
+// stops
+func monitorHints(c *context) {
+	for {
+		time.Sleep(hintReplayInterval)
+
+		replayed, err := replayHints(c)
+		if err != nil {
+			log.Println(err)
+		} else if replayed > 0 {
+			log.Printf("Replayed %v handed off writes", replayed)
+		}
+	}
+}
+
+// Handle listing the writes that were handed off and not yet replayed
+func hintsHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	keys, err := listHintedKeys(c.db)
+	if err != nil {
+		http.Error(w, "An error occurred while listing hints", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	hints := []keyHint{}
+	for _, key := range keys {
+		keyHints, err := lookupHints(c.db, key)
+		if err != nil {
+			http.Error(w, "An error occurred while listing hints", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		for _, h := range keyHints {
+			hints = append(hints, keyHint{key, h})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hints)
+}
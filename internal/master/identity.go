@@ -0,0 +1,108 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/orellazri/tdkvs/internal/utils"
+)
+
+// Keys of the cluster id and of the ids of the volume servers in BadgerDB
+const (
+	clusterIDKey  = "_meta_cluster_id"
+	identitiesKey = "_meta_identities"
+)
+
+// Returned when a volume server could not be reached to verify it
+var errUnverified = errors.New("volume server could not be verified")
+
+// Retrieve the id of the cluster
+// A new id is generated and persisted the first time
+func getClusterID(db *store) (string, error) {
+	id, err := getMetaString(db, clusterIDKey)
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return id, err
+	}
+
+	id, err = utils.RandomID()
+	if err != nil {
+		return "", err
+	}
+	return id, setMetaString(db, clusterIDKey, id)
+}
+
+// Retrieve the volume id of every volume server that was verified
+func getIdentities(db *store) (map[string]string, error) {
+	identities := make(map[string]string)
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(identitiesKey))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &identities)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return identities, nil
+	}
+	return identities, err
+}
+
+// Persist the volume ids of the volume servers in a transaction
+func putIdentities(txn kvTxn, identities map[string]string) error {
+	value, err := json.Marshal(identities)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(identitiesKey), value)
+}
+
+// Check that a url points to the volume server that the master server
+// expects, and claim it for the cluster
+// A volume server must not belong to another cluster, must have the same
+// volume id as the last time it was verified, and must not be the storage
+// directory of another volume server. A volume server that was never
+// verified is remembered by its volume id
+func (c *context) verifyVolume(url string) error {
+	id, err := claimVolume(url, c.clusterID)
+	if errors.Is(err, errForeignVolume) {
+		return fmt.Errorf("volume server %v: %w", url, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v: %v", errUnverified, url, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if known, ok := c.identities[url]; ok {
+		if known != id.VolumeID {
+			return fmt.Errorf("volume server %v has volume id %v but %v was expected. It points to another storage directory", url, id.VolumeID, known)
+		}
+		return nil
+	}
+
+	for other, otherID := range c.identities {
+		if otherID == id.VolumeID {
+			return fmt.Errorf("volume server %v has the same volume id as %v. Both point to the same storage directory", url, other)
+		}
+	}
+
+	// Replace the ids instead of changing them in place, like the bucket table
+	identities := map[string]string{url: id.VolumeID}
+	for other, otherID := range c.identities {
+		identities[other] = otherID
+	}
+	err = c.db.Update(func(txn kvTxn) error {
+		return putIdentities(txn, identities)
+	})
+	if err != nil {
+		return err
+	}
+	c.identities = identities
+	return nil
+}
@@ -0,0 +1,82 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/orellazri/tdkvs/internal/placement"
+)
+
+// Key of the labels of the volume servers in BadgerDB
+// Placement depends on the labels, so keys are rebalanced when they change
+const labelsKey = "_meta_labels"
+
+// Zone and rack of a volume server
+type labels struct {
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+}
+
+// Retrieve the labels that keys were placed with
+// Keys placed before volume servers could be labeled have no labels
+func getLabels(db *store) (map[string]labels, error) {
+	l := make(map[string]labels)
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(labelsKey))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &l)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return l, nil
+	}
+	return l, err
+}
+
+// Persist the labels in a transaction
+func putLabels(txn kvTxn, l map[string]labels) error {
+	value, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(labelsKey), value)
+}
+
+// Check if two sets of labels are the same
+// Volume servers without labels are left out of both
+func sameLabels(a map[string]labels, b map[string]labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for url, l := range a {
+		if other, ok := b[url]; !ok || other != l {
+			return false
+		}
+	}
+	return true
+}
+
+// Count the distinct zones of the volume servers with a positive weight
+func countZones(weights map[string]int, l map[string]labels) int {
+	zones := make(map[string]bool)
+	for url, weight := range weights {
+		if weight > 0 {
+			zones[l[url].Zone] = true
+		}
+	}
+	return len(zones)
+}
+
+// Return the failure domains of every bucket
+func bucketDomains(buckets []string, l map[string]labels) []placement.Domain {
+	domains := make([]placement.Domain, len(buckets))
+	for i, url := range buckets {
+		domains[i] = placement.Domain{Zone: l[url].Zone, Rack: l[url].Rack, Volume: url}
+	}
+	return domains
+}
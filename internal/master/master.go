@@ -1,103 +1,567 @@
 package master
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
+	"github.com/orellazri/tdkvs/internal/placement"
 	"github.com/orellazri/tdkvs/internal/utils"
 )
 
 // Config struct to unmarshal from yaml file for the master server
 type Config struct {
 	Port         int      // Server port
-	Volumes      []string // List of volume servers
+	Dir          string   // Optional. Directory of the BadgerDB (defaults to badger)
+	Volumes      []Volume // List of volume servers
+	Replicas     int      // Optional. Number of volume servers to store each key in (defaults to 1)
 	DeleteVolume int      // Optional. Volume server to delete if we are in volume delete mode
+
+	Rename    map[string]string // Optional. Volume servers whose url changed, from their old url to their new one
+	Reconcile bool              // Optional. Whether to decommission volume servers that hold buckets but are not in the config
+	Repair    bool              // Optional. Whether fsck repairs the inconsistencies it finds
+
+	ReadConsistency  string `yaml:"read_consistency"`  // Optional. Default consistency level for reads (defaults to one)
+	WriteConsistency string `yaml:"write_consistency"` // Optional. Default consistency level for writes and deletes (defaults to all)
+
+	Placement string // Optional. Strategy that chooses the volume servers of a key: jump, rendezvous or ring (defaults to jump)
+	Hash      string // Optional. Function that hashes keys: fnv, xxhash or seeded (defaults to fnv)
+	HashSeed  uint64 `yaml:"hash_seed"` // Optional. Secret seed of the seeded hash function
+
+	SuspectAfter int `yaml:"suspect_after"` // Optional. Seconds without heartbeats after which a volume server is suspect (defaults to 15)
+	DownAfter    int `yaml:"down_after"`    // Optional. Seconds without heartbeats after which a volume server is down (defaults to 60)
+
+	HintedHandoff bool `yaml:"hinted_handoff"` // Optional. Whether to hand off writes to other volume servers while the volume servers of a key are down
+
+	RebalanceWorkers   int   `yaml:"rebalance_workers"`   // Optional. Amount of keys moved in parallel while rebalancing (defaults to 4)
+	RebalanceBandwidth int64 `yaml:"rebalance_bandwidth"` // Optional. Maximum bytes per second transferred while rebalancing (defaults to unlimited)
+
+	GCInterval int `yaml:"gc_interval"` // Optional. Seconds between garbage collections in the volume servers (defaults to 0, disabled)
+	GCGrace    int `yaml:"gc_grace"`    // Optional. Seconds an unreferenced value is kept before it is collected (defaults to 3600)
+
+	Raft    *RaftConfig    // Optional. Replicates the metadata over several master servers
+	Standby *StandbyConfig // Optional. Serves reads from a copy of the metadata of a primary master server until promoted
+}
+
+// Volume server in the config yaml file
+// It can be given as a url, or as a url with a weight and labels
+type Volume struct {
+	URL    string // Url of the volume server
+	Weight int    // Optional. Amount of buckets of the volume server, relative to the others (defaults to 1)
+	Zone   string // Optional. Zone of the volume server (i.e. a data center). Replicas of a key are stored in different zones when possible
+	Rack   string // Optional. Rack of the volume server within its zone
+}
+
+// Unmarshal a volume server from either a url or a mapping
+func (v *Volume) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if unmarshal(&url) == nil {
+		v.URL = url
+		return nil
+	}
+
+	type volume Volume
+	return unmarshal((*volume)(v))
 }
 
 // Context for global state
 type context struct {
-	config *Config
-	db     *badger.DB
+	config    *Config
+	db        *store
+	placement placement.Strategy // Chooses the buckets of keys
+	hash      utils.Hasher       // Hashes keys for placement and for their paths in volume servers
+
+	mu          sync.RWMutex      // Protects the bucket table and the rebalance state
+	buckets     []string          // Volume server of every bucket
+	weights     map[string]int    // Amount of buckets every volume server should have
+	spares      map[string]string // Volume servers that take over the buckets of decommissioned ones
+	labels      map[string]labels // Zone and rack of every labeled volume server
+	clusterID   string            // Id of the cluster, which volume servers are claimed for
+	identities  map[string]string // Volume id of every volume server that was verified
+	rebalancing bool              // Whether a rebalance is running in the background
+	retiring    *retirement       // Volume server that is being decommissioned, if any
+	replacing   *replacement      // Failed volume server that is being replaced, if any
+	control     *rebalanceControl // Progress and controls of the current or last rebalance
+	locks       keyLocks          // Serializes changes to the same key
+	throttle    *throttle         // Limits the bandwidth used while rebalancing
+	health      *healthTracker    // Heartbeats of volume servers
+
+	// Held for reading by requests while they choose and use buckets, and
+	// for writing while buckets are removed or start being drained
+	membership sync.RWMutex
+}
+
+// Amount of locks that keys are spread over
+const numKeyLocks = 256
+
+// Striped locks that serialize changes to the same key, i.e. a key being
+// set while it is moved by a rebalance
+type keyLocks [numKeyLocks]sync.Mutex
+
+// Lock a key. Returns a function that unlocks it
+func (l *keyLocks) lock(key string) func() {
+	lock := &l[utils.HashString(key)%numKeyLocks]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Return the volume server of every bucket
+// The table is replaced, never modified in place, so it is safe to use
+// after the lock is released
+func (c *context) volumes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.buckets
 }
 
 // Opearting mode enum
 const (
 	Normal = iota
 	DeleteVolume
+	Plan
+	Rehash
+	Rebuild
+	Fsck
 )
 
+// Return the name of a mode other than the normal one, as it is given on
+// the command line
+func modeName(mode int) string {
+	switch mode {
+	case DeleteVolume:
+		return "-delete"
+	case Plan:
+		return "-plan"
+	case Rehash:
+		return "-rehash"
+	case Rebuild:
+		return "-rebuild"
+	default:
+		return "fsck"
+	}
+}
+
+// Check if BadgerDB could not be opened because another process holds its
+// directory lock, i.e. a master server that is running
+func inUse(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Another process is using this Badger database")
+}
+
 // Start master server
 func Start(config *Config, mode int) {
-	log.Printf("Master server starting on port %v...", config.Port)
+	if mode != Plan && mode != Fsck {
+		log.Printf("Master server starting on port %v...", config.Port)
+	}
+
+	if config.ReadConsistency == "" {
+		config.ReadConsistency = ConsistencyOne
+	}
+	if config.WriteConsistency == "" {
+		config.WriteConsistency = ConsistencyAll
+	}
+	if config.RebalanceWorkers == 0 {
+		config.RebalanceWorkers = 4
+	}
+	if config.RebalanceWorkers < 0 || config.RebalanceBandwidth < 0 {
+		log.Fatal("Rebalance workers and bandwidth must not be negative")
+	}
+
+	if config.SuspectAfter == 0 {
+		config.SuspectAfter = 15
+	}
+	if config.DownAfter == 0 {
+		config.DownAfter = 60
+	}
+	if config.SuspectAfter < 0 || config.DownAfter < config.SuspectAfter {
+		log.Fatal("Suspect and down times must be positive, and volume servers must be suspect before they are down")
+	}
+
+	if config.GCGrace == 0 {
+		config.GCGrace = 3600
+	}
+	if config.GCInterval < 0 || config.GCGrace < 0 {
+		log.Fatal("Garbage collection interval and grace period must not be negative")
+	}
+
+	if !isConsistencyLevel(config.ReadConsistency) || !isConsistencyLevel(config.WriteConsistency) {
+		log.Fatal("Consistency levels must be one of: one, quorum, all")
+	}
+
+	if config.Placement == "" {
+		config.Placement = placement.Jump
+	}
+	strategy, err := placement.New(config.Placement)
+	utils.AbortOnError(err)
+
+	if config.Hash == "" {
+		config.Hash = utils.HashFNV
+	}
+	hashID := utils.HashID(config.Hash, config.HashSeed)
+	hasher, err := utils.NewHasher(hashID)
+	utils.AbortOnError(err)
 
 	// Initialize BadgerDB
-	options := badger.DefaultOptions("badger")
+	if config.Dir == "" {
+		config.Dir = "badger"
+	}
+	options := badger.DefaultOptions(config.Dir)
 	options.Logger = nil
-	db, err := badger.Open(options)
+	badgerDB, err := badger.Open(options)
+	if inUse(err) && mode == Normal {
+		log.Fatalf("The BadgerDB in %v is in use by another master server", config.Dir)
+	}
+	if inUse(err) {
+		log.Fatalf("The BadgerDB in %v is in use. Stop the master server before running %v", config.Dir, modeName(mode))
+	}
 	utils.AbortOnError(err)
-	defer db.Close()
+	defer badgerDB.Close()
+	db := newStore(badgerDB)
+
+	// A standby master server serves reads from its copy of the metadata
+	// and redirects everything else to the primary master server. Once it
+	// is promoted, it starts as a primary master server over its copy
+	var front *swapHandler
+	if config.Standby != nil {
+		if config.Raft != nil {
+			log.Fatal("A master server cannot be a standby and use raft at the same time")
+		}
+		if mode != Normal {
+			log.Fatal("Standby master servers only run in normal mode. Run the primary master server in this mode instead")
+		}
+
+		s := newStandby(config, db, hashID)
+		front = &swapHandler{handler: standbyHandler(s)}
+		go http.ListenAndServe(fmt.Sprintf("localhost:%v", config.Port), front)
+		log.Printf("Standby master server syncing with primary master server %v", config.Standby.Primary)
+		s.run()
+	}
+
+	// With raft, only the leader runs the master server. The other master
+	// servers replicate its metadata and redirect requests to it until one
+	// of them becomes the leader
+	if config.Raft != nil {
+		// Other modes run while the master server is stopped, so they would
+		// wait for a leader forever on a follower, and their changes would not
+		// be replicated
+		if mode != Normal {
+			log.Fatal("Master servers with raft only run in normal mode")
+		}
+
+		var logs *raftLogStore
+		db.raft, logs, err = startRaft(config.Raft, badgerDB)
+		utils.AbortOnError(err)
+		// The raft log is closed after raft stops, and before the metadata
+		defer func() {
+			db.raft.Shutdown().Error()
+			logs.Close()
+		}()
+
+		front = &swapHandler{handler: followerHandler(config.Raft, db.raft)}
+		go http.ListenAndServe(fmt.Sprintf("localhost:%v", config.Port), front)
+
+		err = waitForLeadership(db.raft)
+		utils.AbortOnError(err)
+		go watchLeadership(db.raft)
+	}
+
+	// Volume servers in the bucket table keep their buckets no matter their
+	// order in the config, and new ones get the next buckets. Before the table
+	// existed, buckets were the indices of the volume servers in the config
+	urls := []string{}
+	for i, volume := range config.Volumes {
+		if config.Volumes[i].Weight == 0 {
+			config.Volumes[i].Weight = 1
+		}
+		if config.Volumes[i].Weight < 0 {
+			log.Fatalf("Weight of volume server %v must not be negative", volume.URL)
+		}
+		urls = append(urls, volume.URL)
+	}
+
+	buckets, err := getBuckets(db)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		buckets = urls
+		err = nil
+	}
+	utils.AbortOnError(err)
+
+	if len(config.Rename) > 0 {
+		buckets, err = renameVolumes(db, buckets, config.Rename, urls)
+		utils.AbortOnError(err)
+		for from, to := range config.Rename {
+			log.Printf("Volume server %v was renamed to %v", from, to)
+		}
+	}
+
+	job, err := getRebalanceJob(db)
+	utils.AbortOnError(err)
+
+	// The bucket table is authoritative, so volume servers that hold buckets
+	// are never dropped silently because they are missing from the config.
+	// The volume servers of a retirement that was interrupted are left out,
+	// since they are removed from the config while they are retired
+	missing := []string{}
+	for _, url := range missingVolumes(buckets, urls) {
+		if job != nil && job.Retiring != nil && (url == job.Retiring.Volume || url == job.Retiring.To) {
+			log.Printf("Volume server %v is not in the config yaml file but is being retired", url)
+			continue
+		}
+		if job != nil && job.Replacing != nil && url == job.Replacing.To {
+			log.Printf("Volume server %v is not in the config yaml file but is replacing volume server %v", url, job.Replacing.Volume)
+			continue
+		}
+		missing = append(missing, url)
+	}
+	if len(missing) > 0 && !config.Reconcile {
+		log.Fatal(membershipError(missing, newVolumes(buckets, urls)))
+	}
+	if reordered(buckets, urls) {
+		log.Println("Volume servers in the config yaml file are not in the order of their buckets. Their buckets are kept")
+	}
+
+	// An index is only rebuilt into an empty BadgerDB. The volume servers
+	// still belong to the cluster of the index that was lost
+	if mode == Rebuild {
+		err := checkRebuildable(db)
+		utils.AbortOnError(err)
+		err = adoptClusterID(db, urls)
+		utils.AbortOnError(err)
+	}
+
+	clusterID, err := getClusterID(db)
+	utils.AbortOnError(err)
+	identities, err := getIdentities(db)
+	utils.AbortOnError(err)
+
+	weights := make(map[string]int)
+	volumeLabels := make(map[string]labels)
+	for _, url := range buckets {
+		weights[url]++
+	}
+	for _, url := range missing {
+		log.Printf("Decommissioning volume server %v since it is not in the config yaml file", url)
+		weights[url] = 0
+	}
+	for _, volume := range config.Volumes {
+		weights[volume.URL] = volume.Weight
+		if volume.Zone != "" || volume.Rack != "" {
+			volumeLabels[volume.URL] = labels{Zone: volume.Zone, Rack: volume.Rack}
+		}
+	}
 
 	// The context holds the global state for the master server
 	context := &context{
-		config,
-		db,
+		config:     config,
+		db:         db,
+		placement:  strategy,
+		hash:       hasher,
+		buckets:    buckets,
+		weights:    weights,
+		spares:     make(map[string]string),
+		labels:     volumeLabels,
+		clusterID:  clusterID,
+		identities: identities,
+		throttle:   newThrottle(config.RebalanceBandwidth),
+		health:     newHealthTracker(time.Duration(config.SuspectAfter)*time.Second, time.Duration(config.DownAfter)*time.Second),
 	}
 
-	if mode == DeleteVolume {
-		err := deleteVolume(context, config.DeleteVolume)
+	// A retirement that was interrupted keeps retiring to the weights it
+	// started with
+	if job != nil && job.Retiring != nil {
+		context.restoreRetirement(job.Retiring)
+	}
+
+	volumes := []Volume{}
+	for _, url := range urls {
+		volumes = append(volumes, Volume{URL: url, Weight: weights[url]})
+	}
+	buckets, _ = mergeBuckets(buckets, volumes)
+	context.buckets = buckets
+
+	if config.Replicas == 0 {
+		config.Replicas = 1
+	}
+	numVolumes := 0
+	for _, weight := range weights {
+		if weight > 0 {
+			numVolumes++
+		}
+	}
+	if config.Replicas < 0 || config.Replicas > numVolumes {
+		log.Fatalf("Replicas must be in the range [1, %v]", numVolumes)
+	}
+	if zones := countZones(weights, volumeLabels); len(volumeLabels) > 0 && zones < config.Replicas {
+		log.Printf("Only %v zones for %v replicas. Some keys will have more than one replica in the same zone", zones, config.Replicas)
+	}
+
+	// Print what a rebalance to the volume servers in the config would move,
+	// without touching any volume server
+	if mode == Plan {
+		if job != nil && job.Retiring != nil {
+			context.retiring = job.Retiring
+		}
+		p, err := computePlan(context)
 		utils.AbortOnError(err)
+		printPlan(os.Stdout, p, config.Replicas)
 		return
 	}
 
-	// Check number of volume servers and rebalance if needed
-	var metaNumVolumes int
-	err = db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("_meta_num_volumes"))
-		if err != nil {
-			return err
-		}
+	// Check the metakeys against the values in the volume servers, and
+	// repair them if asked to
+	if mode == Fsck {
+		metaHash, err := getMetaHash(db, hashID)
+		utils.AbortOnError(err)
+		err = checkHash(db, metaHash, hashID)
+		utils.AbortOnError(err)
 
-		item.Value(func(v []byte) error {
-			metaNumVolumes = int(binary.BigEndian.Uint32(v))
-			return nil
-		})
+		r, err := runFsck(context, config.Repair)
+		utils.AbortOnError(err)
+		printFsck(os.Stdout, r, config.Repair)
+		return
+	}
 
-		return nil
+	// Make sure every url still points to the storage directory it pointed to
+	// before keys are read or moved. Volume servers that are down cannot be
+	// verified, so they are only logged
+	for _, url := range append(missingVolumes(buckets, urls), urls...) {
+		err := context.verifyVolume(url)
+		if errors.Is(err, errUnverified) {
+			log.Println(err)
+		} else {
+			utils.AbortOnError(err)
+		}
+	}
+
+	err = db.Update(func(txn kvTxn) error {
+		return putBuckets(txn, buckets)
 	})
+	utils.AbortOnError(err)
+
+	// Continue retiring a bucket if the master server stopped in the middle
+	// of it
+	if job != nil && job.Retiring != nil && job.NumVolumes == len(buckets) {
+		log.Printf("Resuming retirement of bucket %v of volume server %v", job.Retiring.Bucket, job.Retiring.Volume)
+		context.retiring = job.Retiring
+		context.rebalancing = true
+	}
+
+	// Continue rebuilding a volume server that replaces a failed one
+	if job != nil && job.Replacing != nil {
+		log.Printf("Resuming replacement of volume server %v with %v", job.Replacing.Volume, job.Replacing.To)
+		context.replacing = job.Replacing
+		context.rebalancing = true
+	}
+
+	// Finish moving keys that were being moved when the master server stopped
+	err = resumeMigrations(context)
+	utils.AbortOnError(err)
+
+	// Keys are placed and stored by their hash, so they have to be rehashed
+	// before the master server uses another hash function
+	metaHash, err := getMetaHash(db, hashID)
+	utils.AbortOnError(err)
+	if mode != Rehash {
+		err := checkHash(db, metaHash, hashID)
+		utils.AbortOnError(err)
+	}
+
+	if mode == Rebuild {
+		found, err := rebuildIndex(context)
+		utils.AbortOnError(err)
+		log.Printf("Rebuilt the metakeys of %v keys from the volume servers", found)
+	}
+
+	if mode == DeleteVolume {
+		err := deleteVolume(context, config.DeleteVolume)
+		utils.AbortOnError(err)
+		return
+	}
+
+	// Check number of volume servers and rebalance if needed
+	metaNumVolumes, err := getMetaNumber(db, "_meta_num_volumes")
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
 			// No num volumes meta key, set it
-			err := db.Update(func(txn *badger.Txn) error {
-				var numVolumeBytes [4]byte
-				binary.BigEndian.PutUint32(numVolumeBytes[0:4], uint32(len(config.Volumes)))
-				err := txn.Set([]byte("_meta_num_volumes"), numVolumeBytes[:])
-				return err
+			err := setMetaNumber(db, "_meta_num_volumes", len(buckets))
+			utils.AbortOnError(err)
+			err = setMetaNumber(db, "_meta_replicas", config.Replicas)
+			utils.AbortOnError(err)
+			err = setMetaString(db, "_meta_placement", config.Placement)
+			utils.AbortOnError(err)
+			err = db.Update(func(txn kvTxn) error {
+				return putLabels(txn, volumeLabels)
 			})
 			utils.AbortOnError(err)
+			err = setMetaString(db, "_meta_hash", hashID)
+			utils.AbortOnError(err)
 		} else {
 			utils.AbortOnError(err)
 		}
 	} else {
-		// Num volumes meta key found. Compare with current amount of volume servers
-		// and relanace if needed
-		if metaNumVolumes != len(config.Volumes) {
-			if len(config.Volumes) < metaNumVolumes {
+		// Keys written before replication was supported have a single replica
+		metaReplicas, err := getMetaNumber(db, "_meta_replicas")
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			metaReplicas = 1
+		} else {
+			utils.AbortOnError(err)
+		}
+
+		// Keys written before placement strategies were selectable were placed
+		// with jump consistent hash
+		metaPlacement, err := getMetaString(db, "_meta_placement")
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			metaPlacement = placement.Jump
+		} else {
+			utils.AbortOnError(err)
+		}
+
+		metaLabels, err := getLabels(db)
+		utils.AbortOnError(err)
+
+		// Num volumes meta key found. Compare with current amount of volume servers,
+		// replicas, placement strategy and labels, and relanace if needed
+		if metaNumVolumes != len(buckets) || metaReplicas != config.Replicas || metaPlacement != config.Placement || !sameLabels(metaLabels, volumeLabels) {
+			if len(buckets) < metaNumVolumes {
 				log.Fatal("Current amount of volume servers is less than the last amount! Aborting")
 			}
 
-			err := rebalanceVolumes(context)
-			utils.AbortOnError(err)
+			context.rebalancing = true
 		}
 	}
 
+	if mode == Rehash {
+		err := rehashKeys(context, metaHash, hashID)
+		utils.AbortOnError(err)
+		return
+	}
+	if mode == Rebuild {
+		return
+	}
+
+	// Retire buckets of volume servers whose weight was lowered
+	if !context.rebalancing {
+		context.retiring = context.nextRetirement()
+		context.rebalancing = context.retiring != nil
+	}
+
+	// Rebalance in the background while serving requests
+	if context.rebalancing {
+		go runRebalance(context)
+	}
+
+	go monitorHealth(context)
+	go monitorHints(context)
+	if config.GCInterval > 0 {
+		go monitorGC(context)
+	}
+
 	router := mux.NewRouter()
 	router.HandleFunc("/", indexHandler).Methods("GET")
 	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
@@ -109,293 +573,122 @@ func Start(config *Config, mode int) {
 	router.HandleFunc("/delete/{key}", func(w http.ResponseWriter, r *http.Request) {
 		deleteKeyHandler(w, r, context)
 	}).Methods("DELETE")
+	router.HandleFunc("/admin/volumes", func(w http.ResponseWriter, r *http.Request) {
+		listVolumesHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/admin/volumes", func(w http.ResponseWriter, r *http.Request) {
+		addVolumeHandler(w, r, context)
+	}).Methods("POST")
+	router.HandleFunc("/admin/volumes/{index}", func(w http.ResponseWriter, r *http.Request) {
+		decommissionVolumeHandler(w, r, context)
+	}).Methods("DELETE")
+	router.HandleFunc("/admin/volumes/{index}/replace", func(w http.ResponseWriter, r *http.Request) {
+		replaceVolumeHandler(w, r, context)
+	}).Methods("POST")
+	router.HandleFunc("/admin/unrecoverable", func(w http.ResponseWriter, r *http.Request) {
+		unrecoverableHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/admin/hints", func(w http.ResponseWriter, r *http.Request) {
+		hintsHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/admin/changes", func(w http.ResponseWriter, r *http.Request) {
+		changesHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/admin/gc", func(w http.ResponseWriter, r *http.Request) {
+		gcHandler(w, r, context)
+	}).Methods("POST")
+	router.HandleFunc("/admin/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		heartbeatHandler(w, r, context)
+	}).Methods("POST")
+	router.HandleFunc("/admin/health", func(w http.ResponseWriter, r *http.Request) {
+		healthHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/admin/rebalance", func(w http.ResponseWriter, r *http.Request) {
+		rebalanceStatusHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/admin/rebalance/pause", func(w http.ResponseWriter, r *http.Request) {
+		rebalanceActionHandler(w, r, context, (*rebalanceControl).pause)
+	}).Methods("POST")
+	router.HandleFunc("/admin/rebalance/resume", func(w http.ResponseWriter, r *http.Request) {
+		rebalanceActionHandler(w, r, context, (*rebalanceControl).resume)
+	}).Methods("POST")
+	router.HandleFunc("/admin/rebalance/cancel", func(w http.ResponseWriter, r *http.Request) {
+		rebalanceActionHandler(w, r, context, (*rebalanceControl).cancel)
+	}).Methods("POST")
+	if config.Raft != nil {
+		router.HandleFunc("/admin/raft", func(w http.ResponseWriter, r *http.Request) {
+			raftStatusHandler(w, r, config.Raft, db.raft)
+		}).Methods("GET")
+	}
 	http.Handle("/", router)
+
+	// Followers and standby master servers were redirecting requests while
+	// this master server was starting as the primary. Serve them from now on
+	if front != nil {
+		front.swap(router)
+		select {}
+	}
 	http.ListenAndServe(fmt.Sprintf("localhost:%v", config.Port), router)
 }
 
-// Rebalance keys in volume servers
-func rebalanceVolumes(c *context) error {
-	log.Println("Rebalancing volumes...")
-
-	// Iterate over all keys
-	err := c.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			key := string(item.Key())
-
-			// Skip meta keys
-			if strings.HasPrefix(key, "_meta") {
-				continue
-			}
-
-			// Check if key needs to be moved
-			err := item.Value(func(v []byte) error {
-				currentVolume := binary.BigEndian.Uint32(v)
-				hash, newVolume := utils.ChooseBucketString(key, int32(len(c.config.Volumes)))
-				if newVolume == currentVolume {
-					return nil
-				}
-
-				log.Printf("Moving key \"%v\" to volume server %v", key, c.config.Volumes[newVolume])
-
-				// Get value from current volume server
-				resp, err := http.Get(fmt.Sprintf("%v/get/%v?hash=%v", c.config.Volumes[currentVolume], key, hash))
-				if err != nil {
-					return err
-				}
-				if resp.StatusCode != 200 {
-					return errors.New("respose from volume server is not 200 OK")
-				}
-
-				body, err := io.ReadAll(resp.Body)
-				if err != nil {
-					return err
-				}
-
-				value := body
-
-				resp.Body.Close()
-
-				// Delete key from current volume server
-				req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%v/delete/%v?hash=%v", c.config.Volumes[currentVolume], key, hash), strings.NewReader(""))
-				if err != nil {
-					return err
-				}
-				client := http.Client{}
-				resp, err = client.Do(req)
-				if err != nil {
-					return err
-				}
-
-				if resp.StatusCode != 200 {
-					return errors.New("response from volue server is not 200 OK")
-				}
-				resp.Body.Close()
-
-				// Set key in new volume server
-				req, err = http.NewRequest(http.MethodPut, fmt.Sprintf("%v/set/%v?hash=%v", c.config.Volumes[newVolume], key, hash), bytes.NewBuffer(value))
-				if err != nil {
-					return err
-				}
-				client = http.Client{}
-				resp, err = client.Do(req)
-				if err != nil {
-					return err
-				}
-
-				if resp.StatusCode != 200 {
-					return errors.New("response from volue server is not 200 OK")
-				}
-				resp.Body.Close()
-
-				// Update metakey in db
-				err = c.db.Update(func(txn *badger.Txn) error {
-					var numVolumeBytes [4]byte
-					binary.BigEndian.PutUint32(numVolumeBytes[0:4], uint32(newVolume))
-					err := txn.Set([]byte(key), numVolumeBytes[:])
-					return err
-				})
-				if err != nil {
-					return err
-				}
-
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return err
+// Choose the buckets for a key
+// Buckets of the same volume server are never chosen together, so every
+// replica is stored in a different volume server, and replicas are spread
+// over zones and racks as much as possible. While the last bucket is
+// being drained, keys are placed as if it was already removed
+// Returns the hash and the buckets
+func (c *context) chooseVolumes(key string) (uint64, []uint32) {
+	c.mu.RLock()
+	buckets := c.buckets
+	if c.retiring.draining() {
+		buckets = buckets[:len(buckets)-1]
 	}
+	c.mu.RUnlock()
 
-	// Set metakey to new number of volume servers
-	err = c.db.Update(func(txn *badger.Txn) error {
-		var numVolumeBytes [4]byte
-		binary.BigEndian.PutUint32(numVolumeBytes[0:4], uint32(len(c.config.Volumes)))
-		err := txn.Set([]byte("_meta_num_volumes"), numVolumeBytes[:])
-		return err
-	})
-	if err != nil {
-		return err
-	}
+	return c.chooseBuckets(buckets, key)
+}
+
+// Choose the buckets for a key in the given bucket table
+func (c *context) chooseBuckets(buckets []string, key string) (uint64, []uint32) {
+	c.mu.RLock()
+	domains := bucketDomains(buckets, c.labels)
+	c.mu.RUnlock()
 
-	log.Println("Rebalancing done!")
-	return nil
+	hash := c.hash(key)
+	return hash, placement.Choose(c.placement, hash, domains, c.config.Replicas)
 }
 
-// Move keys from a volume server
-func deleteVolume(c *context, index int) error {
-	if len(c.config.Volumes) == 1 {
-		log.Fatal("You cannot delete the last volume server")
+// Check if two lists of volume servers contain the same volume servers
+func sameVolumes(a []uint32, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
 	}
 
-	if index < 0 || index >= len(c.config.Volumes) {
-		log.Fatalf("Volume %v is not in the range [0, %v)", index, len(c.config.Volumes))
+	set := make(map[uint32]bool)
+	for _, v := range a {
+		set[v] = true
 	}
-
-	log.Printf("Deleting volume %v...", index)
-
-	// Copy volumes array to a new array
-	newVolumes := make([]string, len(c.config.Volumes))
-	copy(newVolumes, c.config.Volumes)
-	newVolumes = append(newVolumes[:index], newVolumes[index+1:]...)
-
-	// Iterate over all keys
-	err := c.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			key := string(item.Key())
-
-			// Skip meta keys
-			if strings.HasPrefix(key, "_meta") {
-				continue
-			}
-
-			err := item.Value(func(v []byte) error {
-				currentVolume := binary.BigEndian.Uint32(v)
-				if currentVolume != uint32(index) {
-					return nil
-				}
-
-				// Key is in the volume that's going to be deleted. Move it
-				hash, newVolume := utils.ChooseBucketString(key, int32(len(newVolumes)))
-
-				log.Printf("Moving key \"%v\" to volume server %v", key, newVolumes[newVolume])
-
-				// Get value from current volume server
-				resp, err := http.Get(fmt.Sprintf("%v/get/%v?hash=%v", c.config.Volumes[currentVolume], key, hash))
-				if err != nil {
-					return err
-				}
-				if resp.StatusCode != 200 {
-					return errors.New("respose from volume server is not 200 OK")
-				}
-
-				body, err := io.ReadAll(resp.Body)
-				if err != nil {
-					return err
-				}
-
-				value := body
-
-				resp.Body.Close()
-
-				// Delete key from current volume server
-				req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%v/delete/%v?hash=%v", c.config.Volumes[currentVolume], key, hash), strings.NewReader(""))
-				if err != nil {
-					return err
-				}
-				client := http.Client{}
-				resp, err = client.Do(req)
-				if err != nil {
-					return err
-				}
-
-				if resp.StatusCode != 200 {
-					return errors.New("response from volue server is not 200 OK")
-				}
-				resp.Body.Close()
-
-				// Set key in new volume server
-				req, err = http.NewRequest(http.MethodPut, fmt.Sprintf("%v/set/%v?hash=%v", newVolumes[newVolume], key, hash), bytes.NewBuffer(value))
-				if err != nil {
-					return err
-				}
-				client = http.Client{}
-				resp, err = client.Do(req)
-				if err != nil {
-					return err
-				}
-
-				if resp.StatusCode != 200 {
-					return errors.New("response from volue server is not 200 OK")
-				}
-				resp.Body.Close()
-
-				// Update metakey in db
-				err = c.db.Update(func(txn *badger.Txn) error {
-					var numVolumeBytes [4]byte
-					binary.BigEndian.PutUint32(numVolumeBytes[0:4], uint32(newVolume))
-					err := txn.Set([]byte(key), numVolumeBytes[:])
-					return err
-				})
-				if err != nil {
-					return err
-				}
-				return nil
-			})
-			if err != nil {
-				return err
-			}
+	for _, v := range b {
+		if !set[v] {
+			return false
 		}
-		return nil
-	})
-	utils.AbortOnError(err)
-
-	// Decrease the volume number for all keys that are greater than the index
-	err = c.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			key := string(item.Key())
-
-			// Skip meta keys
-			if strings.HasPrefix(key, "_meta") {
-				continue
-			}
-
-			err := item.Value(func(v []byte) error {
-				currentVolume := binary.BigEndian.Uint32(v)
-				if currentVolume <= uint32(index) {
-					return nil
-				}
-
-				err := c.db.Update(func(txn *badger.Txn) error {
-					newVolume := make([]byte, 4)
-					binary.BigEndian.PutUint32(newVolume, currentVolume-1)
-					err := txn.Set([]byte(key), newVolume)
-					if err != nil {
-						return err
-					}
-					return nil
-				})
-				if err != nil {
-					return err
-				}
-
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return err
 	}
+	return true
+}
 
-	// Rebalance all keys
-	c.config.Volumes = newVolumes
-
-	err = rebalanceVolumes(c)
-	if err != nil {
-		return err
+// Retire all the buckets of a volume server
+// This runs before the master server starts serving requests
+func deleteVolume(c *context, index int) error {
+	if c.retiring != nil {
+		log.Printf("Resuming decommission of volume server %v", c.retiring.Volume)
+	} else {
+		err := validateRetirement(c, index, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.retiring = c.decommission(index, "")
 	}
 
-	return nil
+	log.Printf("Deleting volume %v...", c.retiring.Volume)
+	return rebalanceVolumes(c)
 }
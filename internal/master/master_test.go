@@ -1,16 +1,27 @@
 package master
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
+	"github.com/hashicorp/raft"
+	"github.com/orellazri/tdkvs/internal/placement"
 	"github.com/orellazri/tdkvs/internal/utils"
+	"gopkg.in/yaml.v2"
 )
 
 func TestGetNonexistentKey(t *testing.T) {
@@ -22,8 +33,8 @@ func TestGetNonexistentKey(t *testing.T) {
 	defer db.Close()
 
 	context := &context{
-		config: &Config{Port: 3000, Volumes: []string{"http://localhost:3001"}},
-		db:     db,
+		config: &Config{Port: 3000, Volumes: []Volume{{URL: "http://localhost:3001"}}},
+		db:     newStore(db),
 	}
 
 	router := mux.NewRouter()
@@ -52,3 +63,2134 @@ func TestGetNonexistentKey(t *testing.T) {
 		t.Error("response does not contain: \"does not exist\"")
 	}
 }
+
+// Start a fake volume server that stores values in memory
+func newTestVolume() (*httptest.Server, map[string][]byte) {
+	values := make(map[string][]byte)
+	var mu sync.Mutex
+
+	volumeID, _ := utils.RandomID()
+	clusterID := ""
+
+	router := mux.NewRouter()
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	router.HandleFunc("/identity", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if clusterID != "" && clusterID != r.URL.Query().Get("cluster") {
+			http.Error(w, "Volume server belongs to cluster "+clusterID, http.StatusConflict)
+			return
+		}
+		clusterID = r.URL.Query().Get("cluster")
+		json.NewEncoder(w).Encode(volumeIdentity{volumeID, clusterID})
+	}).Methods("POST")
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		value, ok := values[mux.Vars(r)["key"]]
+		if !ok {
+			http.Error(w, "does not exist", http.StatusInternalServerError)
+			return
+		}
+		w.Write(value)
+	}).Methods("GET")
+	router.HandleFunc("/checksum/{key}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		value, ok := values[mux.Vars(r)["key"]]
+		if !ok {
+			http.Error(w, "does not exist", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(utils.Checksum(value)))
+	}).Methods("GET")
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		value, _ := io.ReadAll(r.Body)
+		values[mux.Vars(r)["key"]] = value
+	}).Methods("PUT")
+	router.HandleFunc("/delete/{key}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(values, mux.Vars(r)["key"])
+	}).Methods("DELETE")
+	router.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Trailer", "X-Tdkvs-Count")
+		for key, value := range values {
+			json.NewEncoder(w).Encode(volumeKey{Key: key, Hash: fmt.Sprint(utils.HashString(key)), Size: int64(len(value))})
+		}
+		w.Header().Set("X-Tdkvs-Count", fmt.Sprint(len(values)))
+	}).Methods("GET")
+	router.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
+		referenced := make(map[string]bool)
+		decoder := json.NewDecoder(r.Body)
+		for {
+			k := map[string]string{}
+			if decoder.Decode(&k) != nil {
+				break
+			}
+			referenced[k["key"]] = true
+		}
+		if r.Trailer.Get("X-Tdkvs-Count") != fmt.Sprint(len(referenced)) {
+			http.Error(w, "cut short", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		collection := volumeCollection{Scanned: len(values)}
+		for key := range values {
+			if !referenced[key] {
+				delete(values, key)
+				collection.Deleted++
+			}
+		}
+		json.NewEncoder(w).Encode(collection)
+	}).Methods("POST")
+
+	return httptest.NewServer(router), values
+}
+
+// Create a context with a fresh BadgerDB and the given volume servers
+func newTestContext(t *testing.T, volumes []string, replicas int) *context {
+	options := badger.DefaultOptions(t.TempDir())
+	options.Logger = nil
+	db, err := badger.Open(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	config := []Volume{}
+	weights := make(map[string]int)
+	for _, url := range volumes {
+		config = append(config, Volume{URL: url, Weight: 1})
+		weights[url] = 1
+	}
+
+	strategy, err := placement.New(placement.Jump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &context{
+		config: &Config{
+			Port:             3000,
+			Volumes:          config,
+			Replicas:         replicas,
+			Placement:        placement.Jump,
+			ReadConsistency:  ConsistencyOne,
+			WriteConsistency: ConsistencyAll,
+			RebalanceWorkers: 4,
+		},
+		db:         newStore(db),
+		placement:  strategy,
+		hash:       utils.HashString,
+		buckets:    volumes,
+		weights:    weights,
+		spares:     make(map[string]string),
+		labels:     make(map[string]labels),
+		clusterID:  "test",
+		identities: make(map[string]string),
+		health:     newHealthTracker(15*time.Second, 60*time.Second),
+	}
+}
+
+func TestSetKeyReplicas(t *testing.T) {
+	volume1, values1 := newTestVolume()
+	defer volume1.Close()
+	volume2, values2 := newTestVolume()
+	defer volume2.Close()
+	volume3, values3 := newTestVolume()
+	defer volume3.Close()
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL, volume3.URL}, 2)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, context)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/test", strings.NewReader("value"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatal("response status code is not 200 OK")
+	}
+
+	replicas := len(values1) + len(values2) + len(values3)
+	if replicas != 2 {
+		t.Errorf("expected 2 replicas but got %v", replicas)
+	}
+}
+
+func TestSetReservedKey(t *testing.T) {
+	volume, values := newTestVolume()
+	defer volume.Close()
+
+	context := newTestContext(t, []string{volume.URL}, 1)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, context)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/_meta_buckets", strings.NewReader("value"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected reserved key to be rejected but got %v", resp.StatusCode)
+	}
+	if len(values) != 0 {
+		t.Error("expected reserved key not to be stored in the volume server")
+	}
+}
+
+func TestGetKeyFallsBackToReplica(t *testing.T) {
+	volume1, _ := newTestVolume()
+	volume2, values2 := newTestVolume()
+	defer volume2.Close()
+
+	// First replica is down
+	volume1.Close()
+	values2["test"] = []byte("value")
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL}, 2)
+	err := context.db.Update(func(txn kvTxn) error {
+		return setMetakey(txn, "test", &metakey{Volumes: []uint32{0, 1}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
+		getKeyHandler(w, r, context)
+	}).Methods("GET")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/get/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "value" {
+		t.Errorf("expected value from second replica but got %v: %v", resp.StatusCode, string(body))
+	}
+}
+
+func TestDecodeLegacyMetakey(t *testing.T) {
+	m, err := decodeMetakey([]byte{0, 0, 0, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Volumes) != 1 || m.Volumes[0] != 3 {
+		t.Errorf("expected volumes [3] but got %v", m.Volumes)
+	}
+}
+
+func TestSetKeyConsistency(t *testing.T) {
+	volume1, _ := newTestVolume()
+	volume2, _ := newTestVolume()
+	defer volume2.Close()
+	volume3, _ := newTestVolume()
+	defer volume3.Close()
+
+	// One of the replicas is down
+	volume1.Close()
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL, volume3.URL}, 3)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, context)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	tests := []struct {
+		consistency string
+		statusCode  int
+	}{
+		{ConsistencyAll, 500},
+		{ConsistencyQuorum, 200},
+		{ConsistencyOne, 200},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/test?consistency="+test.consistency, strings.NewReader("value"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.statusCode {
+			t.Errorf("expected status code %v for consistency %v but got %v", test.statusCode, test.consistency, resp.StatusCode)
+		}
+		if resp.Header.Get("X-Tdkvs-Replicas") != "2/3" {
+			t.Errorf("expected 2/3 replicas but got %v", resp.Header.Get("X-Tdkvs-Replicas"))
+		}
+	}
+}
+
+func TestRequiredReplicas(t *testing.T) {
+	tests := []struct {
+		consistency string
+		replicas    int
+		expected    int
+	}{
+		{ConsistencyOne, 3, 1},
+		{ConsistencyQuorum, 3, 2},
+		{ConsistencyQuorum, 4, 3},
+		{ConsistencyAll, 3, 3},
+	}
+
+	for _, test := range tests {
+		actual := requiredReplicas(test.consistency, test.replicas)
+		if actual != test.expected {
+			t.Errorf("expected %v for %v of %v replicas but got %v", test.expected, test.consistency, test.replicas, actual)
+		}
+	}
+}
+
+func TestMigrateKey(t *testing.T) {
+	volume1, values1 := newTestVolume()
+	defer volume1.Close()
+	volume2, values2 := newTestVolume()
+	defer volume2.Close()
+
+	values1["test"] = []byte("value")
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL}, 1)
+	err := context.db.Update(func(txn kvTxn) error {
+		return setMetakey(txn, "test", &metakey{Volumes: []uint32{0}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateKey(context, "test", utils.HashString("test"), []uint32{0}, []uint32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := values1["test"]; ok {
+		t.Error("key still exists in source volume server")
+	}
+	if string(values2["test"]) != "value" {
+		t.Errorf("expected value in destination volume server but got %v", string(values2["test"]))
+	}
+
+	err = context.db.View(func(txn *badger.Txn) error {
+		m, err := getMetakey(txn, "test")
+		if err != nil {
+			return err
+		}
+		if !sameVolumes(m.Volumes, []uint32{1}) {
+			t.Errorf("expected metakey volumes [1] but got %v", m.Volumes)
+		}
+
+		_, err = txn.Get([]byte(migrationPrefix + "test"))
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			t.Error("journal entry still exists after move")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateDeletedKey(t *testing.T) {
+	volume1, values1 := newTestVolume()
+	defer volume1.Close()
+	volume2, values2 := newTestVolume()
+	defer volume2.Close()
+
+	// The value is still in the source volume server, but a client deleted
+	// the metakey while the key was being moved
+	values1["test"] = []byte("value")
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL}, 1)
+	err := migrateKey(context, "test", utils.HashString("test"), []uint32{0}, []uint32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := values2["test"]; ok {
+		t.Error("expected copy in destination volume server to be deleted")
+	}
+
+	err = context.db.View(func(txn *badger.Txn) error {
+		_, err := getMetakey(txn, "test")
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			t.Error("expected deleted key not to be recreated")
+		}
+		_, err = txn.Get([]byte(migrationPrefix + "test"))
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			t.Error("journal entry still exists after move")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailedMigrationKeepsSource(t *testing.T) {
+	volume1, values1 := newTestVolume()
+	defer volume1.Close()
+	volume2, _ := newTestVolume()
+
+	// Destination is down
+	volume2.Close()
+	values1["test"] = []byte("value")
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL}, 1)
+	err := migrateKey(context, "test", utils.HashString("test"), []uint32{0}, []uint32{1})
+	if err == nil {
+		t.Fatal("expected move to a volume server that is down to fail")
+	}
+
+	if string(values1["test"]) != "value" {
+		t.Error("key was deleted from source volume server after a failed move")
+	}
+}
+
+func TestRebalanceResumesFromLastKey(t *testing.T) {
+	volume1, values1 := newTestVolume()
+	defer volume1.Close()
+	volume2, _ := newTestVolume()
+	defer volume2.Close()
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL}, 1)
+
+	// All keys are in the first volume server, and the rebalance was
+	// interrupted after processing "key4"
+	keys := []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9"}
+	err := context.db.Update(func(txn kvTxn) error {
+		for _, key := range keys {
+			values1[key] = []byte(key)
+			err := setMetakey(txn, key, &metakey{Volumes: []uint32{0}})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setRebalanceJob(context.db, &rebalanceJob{NumVolumes: 2, Replicas: 1, LastKey: "key4", Scanned: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rebalanceVolumes(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = context.db.View(func(txn *badger.Txn) error {
+		for i, key := range keys {
+			m, err := getMetakey(txn, key)
+			if err != nil {
+				return err
+			}
+
+			_, expected := utils.ChooseBucketString(key, 2)
+			if i <= 4 {
+				expected = 0
+			}
+			if !sameVolumes(m.Volumes, []uint32{expected}) {
+				t.Errorf("expected key %v in volume server %v but got %v", key, expected, m.Volumes)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := getRebalanceJob(context.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job != nil {
+		t.Error("rebalance job still exists after rebalance is done")
+	}
+
+	numVolumes, err := getMetaNumber(context.db, "_meta_num_volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numVolumes != 2 {
+		t.Errorf("expected _meta_num_volumes to be 2 but got %v", numVolumes)
+	}
+}
+
+func TestAddVolumeRebalancesInBackground(t *testing.T) {
+	volume1, _ := newTestVolume()
+	defer volume1.Close()
+	volume2, _ := newTestVolume()
+	defer volume2.Close()
+
+	context := newTestContext(t, []string{volume1.URL}, 1)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
+		getKeyHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, context)
+	}).Methods("PUT")
+	router.HandleFunc("/admin/volumes", func(w http.ResponseWriter, r *http.Request) {
+		addVolumeHandler(w, r, context)
+	}).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	keys := []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9"}
+	for _, key := range keys {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/"+key, strings.NewReader(key))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Post(server.URL+"/admin/volumes", "text/plain", strings.NewReader(volume2.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status code 202 but got %v", resp.StatusCode)
+	}
+
+	// Keys can be read while the rebalance is running
+	for {
+		for _, key := range keys {
+			resp, err := http.Get(server.URL + "/get/" + key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != key {
+				t.Errorf("expected %v but got %v", key, string(body))
+			}
+		}
+
+		context.mu.RLock()
+		rebalancing := context.rebalancing
+		context.mu.RUnlock()
+		if !rebalancing {
+			break
+		}
+	}
+
+	for _, key := range keys {
+		m, err := lookupMetakey(context, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, expected := utils.ChooseBucketString(key, 2)
+		if !sameVolumes(m.Volumes, []uint32{expected}) {
+			t.Errorf("expected key %v in volume server %v but got %v", key, expected, m.Volumes)
+		}
+	}
+}
+
+func TestDecommissionVolume(t *testing.T) {
+	volume1, _ := newTestVolume()
+	defer volume1.Close()
+	volume2, values2 := newTestVolume()
+	defer volume2.Close()
+	volume3, _ := newTestVolume()
+	defer volume3.Close()
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL, volume3.URL}, 1)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
+		getKeyHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, context)
+	}).Methods("PUT")
+	router.HandleFunc("/admin/volumes/{index}", func(w http.ResponseWriter, r *http.Request) {
+		decommissionVolumeHandler(w, r, context)
+	}).Methods("DELETE")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	keys := []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9"}
+	for _, key := range keys {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/"+key, strings.NewReader(key))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	stored := len(values2)
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/admin/volumes/1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status code 202 but got %v", resp.StatusCode)
+	}
+
+	for {
+		context.mu.RLock()
+		rebalancing := context.rebalancing
+		context.mu.RUnlock()
+		if !rebalancing {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The last volume server took over the bucket of the decommissioned one
+	volumes := context.volumes()
+	if len(volumes) != 2 || volumes[0] != volume1.URL || volumes[1] != volume3.URL {
+		t.Fatalf("expected volume server 1 to be removed but got %v", volumes)
+	}
+	buckets, err := getBuckets(context.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets[1] != volume3.URL {
+		t.Errorf("expected persisted buckets to be %v but got %v", volumes, buckets)
+	}
+	if len(values2) != stored {
+		t.Errorf("expected decommissioned volume server to be left untouched but it has %v keys", len(values2))
+	}
+
+	for _, key := range keys {
+		resp, err := http.Get(server.URL + "/get/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != key {
+			t.Errorf("expected %v but got %v", key, string(body))
+		}
+	}
+}
+
+func TestDecommissionVolumeWithSpare(t *testing.T) {
+	volume1, _ := newTestVolume()
+	defer volume1.Close()
+	volume2, values2 := newTestVolume()
+	defer volume2.Close()
+	volume3, _ := newTestVolume()
+	defer volume3.Close()
+	spare, spareValues := newTestVolume()
+	defer spare.Close()
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL, volume3.URL}, 1)
+
+	// Keys in the second bucket, including one with a legacy metakey
+	err := context.db.Update(func(txn kvTxn) error {
+		values2["key0"] = []byte("key0")
+		values2["key1"] = []byte("key1")
+		err := setMetakey(txn, "key0", &metakey{Volumes: []uint32{1}, Size: 4})
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte("key1"), []byte{0, 0, 0, 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	context.retiring = context.decommission(1, spare.URL)
+	err = rebalanceVolumes(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volumes := context.volumes()
+	if len(volumes) != 3 || volumes[1] != spare.URL {
+		t.Fatalf("expected bucket 1 to point to the spare volume server but got %v", volumes)
+	}
+	if string(spareValues["key0"]) != "key0" || string(spareValues["key1"]) != "key1" {
+		t.Error("keys were not copied to the spare volume server")
+	}
+
+	// Metakeys were not rewritten
+	err = context.db.View(func(txn *badger.Txn) error {
+		m, err := getMetakey(txn, "key0")
+		if err != nil {
+			return err
+		}
+		if !sameVolumes(m.Volumes, []uint32{1}) || m.Size != 4 {
+			t.Errorf("expected metakey of key0 to be unchanged but got %v", m)
+		}
+
+		item, err := txn.Get([]byte("key1"))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			if len(v) != 4 {
+				t.Error("expected legacy metakey of key1 to be unchanged")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplaceVolume(t *testing.T) {
+	volume1, _ := newTestVolume()
+	volume2, values2 := newTestVolume()
+	defer volume2.Close()
+	volume3, values3 := newTestVolume()
+	defer volume3.Close()
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL}, 2)
+
+	// key0 has a replica in both volume servers, key1 only in the failed one
+	err := context.db.Update(func(txn kvTxn) error {
+		values2["key0"] = []byte("key0")
+		err := setMetakey(txn, "key0", &metakey{Volumes: []uint32{0, 1}, Size: 4})
+		if err != nil {
+			return err
+		}
+		return setMetakey(txn, "key1", &metakey{Volumes: []uint32{0}, Size: 4})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume1.Close()
+
+	err = context.replaceVolume(&replacement{Volume: volume1.URL, To: volume3.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rebalanceVolumes(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buckets, err := getBuckets(context.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets[0] != volume3.URL || buckets[1] != volume2.URL {
+		t.Fatalf("expected bucket 0 to point to the new volume server but got %v", buckets)
+	}
+	if string(values3["key0"]) != "key0" {
+		t.Error("key0 was not rebuilt in the new volume server")
+	}
+	if context.replacing != nil {
+		t.Error("expected replacement to be finished")
+	}
+
+	unrecoverable, err := listUnrecoverable(context.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unrecoverable) != 1 || unrecoverable[0].Key != "key1" || unrecoverable[0].Volume != volume1.URL {
+		t.Fatalf("expected key1 to be unrecoverable but got %v", unrecoverable)
+	}
+}
+
+func TestWritesGoToRemapTarget(t *testing.T) {
+	volume1, values1 := newTestVolume()
+	defer volume1.Close()
+	spare, spareValues := newTestVolume()
+	defer spare.Close()
+
+	context := newTestContext(t, []string{volume1.URL}, 1)
+	context.retiring = newRetirement(context.buckets, 0, spare.URL)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, context)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/test", strings.NewReader("value"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if string(values1["test"]) != "value" || string(spareValues["test"]) != "value" {
+		t.Error("expected key to be written to both volume servers of a remapped bucket")
+	}
+}
+
+func TestUnmarshalVolumes(t *testing.T) {
+	config := &Config{}
+	err := yaml.Unmarshal([]byte("volumes:\n  - http://localhost:3001\n  - url: http://localhost:3002\n    weight: 4\n    zone: eu\n    rack: r1\n"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Volume{{URL: "http://localhost:3001"}, {URL: "http://localhost:3002", Weight: 4, Zone: "eu", Rack: "r1"}}
+	if len(config.Volumes) != 2 || config.Volumes[0] != expected[0] || config.Volumes[1] != expected[1] {
+		t.Errorf("expected volumes %v but got %v", expected, config.Volumes)
+	}
+}
+
+func TestReplicasInDifferentVolumeServers(t *testing.T) {
+	context := newTestContext(t, []string{"http://localhost:3001", "http://localhost:3002"}, 2)
+	context.buckets = []string{"http://localhost:3001", "http://localhost:3001", "http://localhost:3001", "http://localhost:3002"}
+
+	for i := 0; i < 100; i++ {
+		_, buckets := context.chooseVolumes(fmt.Sprintf("key%v", i))
+		urls := context.bucketVolumes(buckets)
+		if len(urls) != 2 {
+			t.Fatalf("expected replicas in 2 volume servers but got %v", urls)
+		}
+	}
+}
+
+func TestReplicasInDifferentZones(t *testing.T) {
+	urls := []string{"http://localhost:3001", "http://localhost:3002", "http://localhost:3003", "http://localhost:3004"}
+	context := newTestContext(t, urls, 2)
+	context.labels[urls[0]] = labels{Zone: "eu"}
+	context.labels[urls[1]] = labels{Zone: "eu"}
+	context.labels[urls[2]] = labels{Zone: "us"}
+	context.labels[urls[3]] = labels{Zone: "us"}
+
+	for i := 0; i < 100; i++ {
+		_, buckets := context.chooseVolumes(fmt.Sprintf("key%v", i))
+		if context.labels[urls[buckets[0]]].Zone == context.labels[urls[buckets[1]]].Zone {
+			t.Fatalf("expected replicas in different zones but got volume servers %v and %v", urls[buckets[0]], urls[buckets[1]])
+		}
+	}
+}
+
+func TestLowerWeightRetiresBuckets(t *testing.T) {
+	volume1, _ := newTestVolume()
+	defer volume1.Close()
+	volume2, _ := newTestVolume()
+	defer volume2.Close()
+
+	// The second volume server has a weight of 3
+	context := newTestContext(t, []string{volume1.URL, volume2.URL}, 1)
+	context.buckets = []string{volume1.URL, volume2.URL, volume2.URL, volume2.URL}
+	context.weights[volume2.URL] = 3
+
+	router := mux.NewRouter()
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
+		getKeyHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, context)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	keys := []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9"}
+	for _, key := range keys {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/"+key, strings.NewReader(key))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	context.weights[volume2.URL] = 1
+	context.retiring = context.nextRetirement()
+	err := rebalanceVolumes(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volumes := context.volumes()
+	if len(volumes) != 2 || volumes[0] != volume1.URL || volumes[1] != volume2.URL {
+		t.Fatalf("expected one bucket for every volume server but got %v", volumes)
+	}
+
+	for _, key := range keys {
+		m, err := lookupMetakey(context, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, expected := context.chooseVolumes(key)
+		if !sameVolumes(m.Volumes, expected) {
+			t.Errorf("expected key %v in buckets %v but got %v", key, expected, m.Volumes)
+		}
+
+		resp, err := http.Get(server.URL + "/get/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != key {
+			t.Errorf("expected %v but got %v", key, string(body))
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	throttle := newThrottle(1000)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		throttle.wait(100)
+	}
+
+	// The first transfer starts right away, and the other two wait 100ms each
+	elapsed := time.Since(start)
+	if elapsed < 200*time.Millisecond {
+		t.Errorf("expected transfers to take at least 200ms but took %v", elapsed)
+	}
+}
+
+func TestPushReservesBandwidth(t *testing.T) {
+	var mu sync.Mutex
+	pushes := []time.Time{}
+	router := mux.NewRouter()
+	router.HandleFunc("/push/{key}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pushes = append(pushes, time.Now())
+		mu.Unlock()
+		json.NewEncoder(w).Encode(pushResponse{500, "checksum"})
+	}).Methods("POST")
+	source := httptest.NewServer(router)
+	defer source.Close()
+
+	context := newTestContext(t, []string{source.URL}, 1)
+	context.throttle = newThrottle(1000)
+	err := context.db.Update(func(txn kvTxn) error {
+		for _, key := range []string{"key0", "key1"} {
+			err := setMetakey(txn, key, &metakey{Volumes: []uint32{0}, Size: 500})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both values are pushed at the same time, so the second push waits for
+	// the bandwidth the first one reserved
+	var wg sync.WaitGroup
+	for _, key := range []string{"key0", "key1"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			_, _, err := transferValue(context, key, utils.HashString(key), []string{source.URL}, "http://localhost:3002", utils.HashString(key))
+			if err != nil {
+				t.Error(err)
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	if len(pushes) != 2 {
+		t.Fatalf("expected 2 pushes but got %v", len(pushes))
+	}
+	gap := pushes[1].Sub(pushes[0])
+	if gap < 0 {
+		gap = -gap
+	}
+	if gap < 400*time.Millisecond {
+		t.Errorf("expected pushes to be half a second apart but they were %v apart", gap)
+	}
+}
+
+func TestUnlimitedThrottle(t *testing.T) {
+	throttle := newThrottle(0)
+
+	start := time.Now()
+	throttle.wait(1 << 30)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("unlimited throttle should not wait")
+	}
+}
+
+func TestComputePlan(t *testing.T) {
+	context := newTestContext(t, []string{"http://localhost:3001", "http://localhost:3002"}, 1)
+
+	// All keys are in the first volume server. Only some of them have a known size
+	keys := []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9"}
+	err := context.db.Update(func(txn kvTxn) error {
+		for i, key := range keys {
+			m := &metakey{Volumes: []uint32{0}}
+			if i%2 == 0 {
+				m.Size = 10
+			}
+			err := setMetakey(txn, key, m)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := computePlan(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedKeys, expectedBytes, expectedUnknown := 0, int64(0), 0
+	for i, key := range keys {
+		_, bucket := utils.ChooseBucketString(key, 2)
+		if bucket != 1 {
+			continue
+		}
+		expectedKeys++
+		if i%2 == 0 {
+			expectedBytes += 10
+		} else {
+			expectedUnknown++
+		}
+	}
+
+	if p.scanned != len(keys) || p.moving != expectedKeys {
+		t.Errorf("expected %v of %v keys to move but got %v of %v", expectedKeys, len(keys), p.moving, p.scanned)
+	}
+	m := move{"http://localhost:3001", "http://localhost:3002"}
+	if p.keys[m] != expectedKeys || p.deleted["http://localhost:3001"] != expectedKeys {
+		t.Errorf("expected %v keys from volume server 0 to 1 but got %v", expectedKeys, p.keys[m])
+	}
+	if p.bytes[m] != expectedBytes || p.unknownSizes != expectedUnknown {
+		t.Errorf("expected %v bytes and %v unknown sizes but got %v and %v", expectedBytes, expectedUnknown, p.bytes[m], p.unknownSizes)
+	}
+
+	// Nothing was moved
+	key0, err := lookupMetakey(context, "key0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameVolumes(key0.Volumes, []uint32{0}) {
+		t.Error("planning moved a key")
+	}
+}
+
+func TestComputePlanByVolumeServer(t *testing.T) {
+	// The first volume server has two buckets, the second one is new
+	context := newTestContext(t, []string{"http://localhost:3001", "http://localhost:3001", "http://localhost:3002"}, 1)
+	context.weights["http://localhost:3001"] = 2
+
+	keys := []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9"}
+	err := context.db.Update(func(txn kvTxn) error {
+		for i, key := range keys {
+			err := setMetakey(txn, key, &metakey{Volumes: []uint32{uint32(i % 2)}, Size: 10})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := computePlan(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys that only change buckets of the first volume server are not moved
+	expected := 0
+	for _, key := range keys {
+		_, chosen := context.chooseVolumes(key)
+		if chosen[0] == 2 {
+			expected++
+		}
+	}
+
+	if len(p.volumes) != 2 {
+		t.Errorf("expected 2 volume servers in the plan but got %v", p.volumes)
+	}
+	if p.moving != expected || p.keys[move{"http://localhost:3001", "http://localhost:3002"}] != expected {
+		t.Errorf("expected %v keys to move to the new volume server but got %v", expected, p.moving)
+	}
+	if p.keys[move{"http://localhost:3001", "http://localhost:3001"}] != 0 {
+		t.Error("expected no moves between buckets of the same volume server")
+	}
+}
+
+func TestComputePlanLowerWeight(t *testing.T) {
+	context := newTestContext(t, []string{"http://localhost:3001", "http://localhost:3001", "http://localhost:3002"}, 1)
+	context.weights["http://localhost:3001"] = 2
+
+	keys := []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9"}
+	err := context.db.Update(func(txn kvTxn) error {
+		for _, key := range keys {
+			_, chosen := context.chooseVolumes(key)
+			err := setMetakey(txn, key, &metakey{Volumes: chosen, Size: 10})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := computePlan(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.moving != 0 {
+		t.Fatalf("expected no keys to move before the weight is lowered but got %v", p.moving)
+	}
+
+	// The second bucket of the first volume server is retired
+	context.weights["http://localhost:3001"] = 1
+	p, err = computePlan(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are placed in the buckets that are left once the bucket is retired
+	retired := []string{"http://localhost:3001", "http://localhost:3002"}
+	expected := 0
+	for _, key := range keys {
+		_, chosen := context.chooseBuckets(retired, key)
+		m, err := lookupMetakey(context, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if context.volumes()[m.Volumes[0]] != retired[chosen[0]] {
+			expected++
+		}
+	}
+	if expected == 0 || p.moving != expected {
+		t.Errorf("expected %v keys to move but got %v", expected, p.moving)
+	}
+	if p.keys[move{"http://localhost:3001", "http://localhost:3002"}]+p.keys[move{"http://localhost:3002", "http://localhost:3001"}] != expected {
+		t.Errorf("expected %v copies between the volume servers but got %v", expected, p.keys)
+	}
+}
+
+func TestRebalanceControlPauseResumeCancel(t *testing.T) {
+	ctl := newRebalanceControl()
+
+	err := ctl.pause()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctl.status().State != rebalancePaused {
+		t.Errorf("expected state %v but got %v", rebalancePaused, ctl.status().State)
+	}
+
+	// Workers wait while the rebalance is paused
+	proceeded := make(chan bool)
+	go func() {
+		proceeded <- ctl.proceed()
+	}()
+	select {
+	case <-proceeded:
+		t.Fatal("worker proceeded while the rebalance is paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = ctl.resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-proceeded {
+		t.Error("worker did not proceed after the rebalance was resumed")
+	}
+
+	// Cancelling a paused rebalance stops the waiting workers
+	ctl.pause()
+	go func() {
+		proceeded <- ctl.proceed()
+	}()
+	err = ctl.cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if <-proceeded {
+		t.Error("worker proceeded after the rebalance was cancelled")
+	}
+
+	ctl.finish(errRebalanceCancelled)
+	if ctl.status().State != rebalanceCancelled {
+		t.Errorf("expected state %v but got %v", rebalanceCancelled, ctl.status().State)
+	}
+	if ctl.resume() == nil {
+		t.Error("expected resuming a cancelled rebalance to fail")
+	}
+}
+
+func TestCancelledRebalanceKeepsKeysInPlace(t *testing.T) {
+	volume1, values1 := newTestVolume()
+	defer volume1.Close()
+	volume2, _ := newTestVolume()
+	defer volume2.Close()
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL}, 1)
+	err := context.db.Update(func(txn kvTxn) error {
+		values1["test"] = []byte("value")
+		return setMetakey(txn, "test", &metakey{Volumes: []uint32{0}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel the rebalance before it moves anything
+	ctl := newRebalanceControl()
+	ctl.cancel()
+	err = rebalance(context, ctl)
+	if !errors.Is(err, errRebalanceCancelled) {
+		t.Fatalf("expected rebalance to be cancelled but got %v", err)
+	}
+
+	m, err := lookupMetakey(context, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameVolumes(m.Volumes, []uint32{0}) || string(values1["test"]) != "value" {
+		t.Error("key was moved by a cancelled rebalance")
+	}
+}
+
+func TestMigrateKeyPushesDirectly(t *testing.T) {
+	destination, values := newTestVolume()
+	defer destination.Close()
+
+	// Source volume server can only push values, so the move fails if the
+	// value is relayed through the master server
+	router := mux.NewRouter()
+	router.HandleFunc("/push/{key}", func(w http.ResponseWriter, r *http.Request) {
+		value := []byte("value")
+		req, _ := http.NewRequest(http.MethodPut, r.URL.Query().Get("to")+"/set/"+mux.Vars(r)["key"], bytes.NewReader(value))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+		json.NewEncoder(w).Encode(pushResponse{len(value), utils.Checksum(value)})
+	}).Methods("POST")
+	router.HandleFunc("/delete/{key}", func(w http.ResponseWriter, r *http.Request) {}).Methods("DELETE")
+	source := httptest.NewServer(router)
+	defer source.Close()
+
+	context := newTestContext(t, []string{source.URL, destination.URL}, 1)
+	err := context.db.Update(func(txn kvTxn) error {
+		return setMetakey(txn, "test", &metakey{Volumes: []uint32{0}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateKey(context, "test", utils.HashString("test"), []uint32{0}, []uint32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(values["test"]) != "value" {
+		t.Errorf("expected value in destination volume server but got %v", string(values["test"]))
+	}
+
+	m, err := lookupMetakey(context, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != 5 {
+		t.Errorf("expected size 5 to be recorded but got %v", m.Size)
+	}
+}
+
+func TestRehashKeys(t *testing.T) {
+	// Volume server that stores values by hash and key, like a real one
+	values := make(map[string][]byte)
+	var mu sync.Mutex
+	path := func(r *http.Request) string {
+		return r.URL.Query().Get("hash") + "_" + mux.Vars(r)["key"]
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		value, ok := values[path(r)]
+		if !ok {
+			http.Error(w, "does not exist", http.StatusNotFound)
+			return
+		}
+		w.Write(value)
+	}).Methods("GET")
+	router.HandleFunc("/checksum/{key}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(utils.Checksum(values[path(r)])))
+	}).Methods("GET")
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		value, _ := io.ReadAll(r.Body)
+		values[path(r)] = value
+	}).Methods("PUT")
+	router.HandleFunc("/delete/{key}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(values, path(r))
+	}).Methods("DELETE")
+	volume := httptest.NewServer(router)
+	defer volume.Close()
+
+	context := newTestContext(t, []string{volume.URL}, 1)
+	keys := []string{"key0", "key1", "key2"}
+	for _, key := range keys {
+		err := setInVolume(volume.URL, key, utils.HashString(key), []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = context.db.Update(func(txn kvTxn) error {
+			return setMetakey(txn, key, &metakey{Volumes: []uint32{0}})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hasher, err := utils.NewHasher(utils.HashXX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context.hash = hasher
+	err = rehashKeys(context, utils.HashFNV, utils.HashXX)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != len(keys) {
+		t.Errorf("expected %v values but got %v", len(keys), len(values))
+	}
+	for _, key := range keys {
+		value := values[fmt.Sprintf("%v_%v", hasher(key), key)]
+		if string(value) != key {
+			t.Errorf("expected key \"%v\" to be stored under its new hash but got \"%v\"", key, string(value))
+		}
+	}
+
+	metaHash, err := getMetaHash(context.db, utils.HashFNV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaHash != utils.HashXX {
+		t.Errorf("expected keys to be hashed with %v but got %v", utils.HashXX, metaHash)
+	}
+}
+
+func TestMembershipDisagreement(t *testing.T) {
+	buckets := []string{"http://a", "http://b", "http://c", "http://b"}
+
+	missing := missingVolumes(buckets, []string{"http://a", "http://c", "http://d"})
+	if len(missing) != 1 || missing[0] != "http://b" {
+		t.Errorf("expected http://b to be missing but got %v", missing)
+	}
+
+	added := newVolumes(buckets, []string{"http://a", "http://c", "http://d"})
+	if len(added) != 1 || added[0] != "http://d" {
+		t.Errorf("expected http://d to be new but got %v", added)
+	}
+
+	if reordered(buckets, []string{"http://a", "http://b", "http://c", "http://d"}) {
+		t.Error("expected volume servers in the order of their buckets")
+	}
+	if !reordered(buckets, []string{"http://b", "http://a", "http://c"}) {
+		t.Error("expected volume servers to be reordered")
+	}
+}
+
+func TestRenameVolumes(t *testing.T) {
+	context := newTestContext(t, []string{"http://a", "http://b", "http://a"}, 1)
+	err := context.db.Update(func(txn kvTxn) error {
+		return putLabels(txn, map[string]labels{"http://a": {Zone: "eu"}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := []string{"http://b", "http://c"}
+	buckets, err := renameVolumes(context.db, context.buckets, map[string]string{"http://a": "http://c"}, urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"http://c", "http://b", "http://c"}
+	persisted, err := getBuckets(context.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range expected {
+		if buckets[i] != expected[i] || persisted[i] != expected[i] {
+			t.Fatalf("expected buckets %v but got %v (persisted %v)", expected, buckets, persisted)
+		}
+	}
+
+	l, err := getLabels(context.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l["http://c"].Zone != "eu" {
+		t.Errorf("expected the labels to follow the renamed volume server but got %v", l)
+	}
+
+	// The new url must be in the config and hold no buckets
+	_, err = renameVolumes(context.db, buckets, map[string]string{"http://b": "http://c"}, urls)
+	if err == nil {
+		t.Error("expected an error when renaming to a volume server that holds buckets")
+	}
+	_, err = renameVolumes(context.db, buckets, map[string]string{"http://b": "http://d"}, urls)
+	if err == nil {
+		t.Error("expected an error when renaming to a volume server that is not in the config")
+	}
+}
+
+func TestVerifyVolume(t *testing.T) {
+	volume1, _ := newTestVolume()
+	defer volume1.Close()
+	volume2, _ := newTestVolume()
+	defer volume2.Close()
+
+	context := newTestContext(t, []string{volume1.URL, volume2.URL}, 1)
+	for _, url := range []string{volume1.URL, volume2.URL, volume1.URL} {
+		err := context.verifyVolume(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	identities, err := getIdentities(context.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 2 || identities[volume1.URL] == identities[volume2.URL] {
+		t.Fatalf("expected the volume ids of both volume servers to be persisted but got %v", identities)
+	}
+
+	// A url that points to another storage directory
+	context.identities = map[string]string{volume1.URL: identities[volume2.URL]}
+	err = context.verifyVolume(volume1.URL)
+	if err == nil {
+		t.Error("expected an error for a volume server with another volume id")
+	}
+
+	// Two urls that point to the same storage directory
+	err = context.verifyVolume(volume2.URL)
+	if err == nil {
+		t.Error("expected an error for a volume server with the volume id of another one")
+	}
+
+	// A volume server of another cluster
+	context = newTestContext(t, []string{volume1.URL}, 1)
+	context.clusterID = "other"
+	err = context.verifyVolume(volume1.URL)
+	if !errors.Is(err, errForeignVolume) {
+		t.Errorf("expected a volume server of another cluster to be refused but got %v", err)
+	}
+}
+
+func TestHealthStates(t *testing.T) {
+	h := newHealthTracker(15*time.Second, 60*time.Second)
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	urls := []string{"http://a", "http://b", "http://c"}
+	h.beat(heartbeat{URL: "http://a"})
+	h.beat(heartbeat{URL: "http://b"})
+
+	now = now.Add(20 * time.Second)
+	h.beat(heartbeat{URL: "http://b"})
+	if h.state("http://a") != healthSuspect || h.state("http://b") != healthHealthy || h.state("http://c") != healthUnknown {
+		t.Fatalf("expected suspect, healthy and unknown but got %v, %v and %v", h.state("http://a"), h.state("http://b"), h.state("http://c"))
+	}
+
+	now = now.Add(time.Minute)
+	if h.state("http://a") != healthDown {
+		t.Fatalf("expected down but got %v", h.state("http://a"))
+	}
+
+	// Replicas of healthy volume servers are tried first
+	h.beat(heartbeat{URL: "http://b"})
+	ordered := h.order(urls, []uint32{0, 1, 2})
+	if ordered[0] != 1 || ordered[1] != 2 || ordered[2] != 0 {
+		t.Errorf("expected buckets [1 2 0] but got %v", ordered)
+	}
+}
+
+func TestHeartbeatRegistersVolume(t *testing.T) {
+	volume, _ := newTestVolume()
+	defer volume.Close()
+
+	context := newTestContext(t, []string{}, 1)
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		heartbeatHandler(w, r, context)
+	}).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	body, _ := json.Marshal(heartbeat{URL: volume.URL, DiskTotal: 100, DiskFree: 40})
+	resp, err := http.Post(server.URL+"/admin/heartbeat", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected heartbeat to be accepted but got %v", resp.StatusCode)
+	}
+
+	status := context.health.status(nil)
+	if len(status) != 1 || status[0].State != healthHealthy || status[0].DiskFree != 40 || status[0].Member {
+		t.Fatalf("expected a healthy volume server that is not a member but got %+v", status)
+	}
+	if context.identities[volume.URL] == "" {
+		t.Error("expected the volume server to be verified")
+	}
+
+	// A heartbeat from a url that now points to another storage directory
+	context.identities[volume.URL] = "other"
+	body, _ = json.Marshal(heartbeat{URL: volume.URL, ClusterID: "test", VolumeID: "unexpected"})
+	resp, err = http.Post(server.URL+"/admin/heartbeat", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected heartbeat to be refused but got %v", resp.StatusCode)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	volume1, values1 := newTestVolume()
+	defer volume1.Close()
+	volume2, values2 := newTestVolume()
+	defer volume2.Close()
+
+	// A volume server that can be taken down and brought back at the same url
+	var down int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		volume1.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	context := newTestContext(t, []string{flaky.URL, volume2.URL}, 1)
+	context.config.HintedHandoff = true
+
+	// Find a key that is stored in the flaky volume server
+	key := ""
+	for i := 0; key == ""; i++ {
+		if _, volumes := context.chooseVolumes(fmt.Sprint("key", i)); volumes[0] == 0 {
+			key = fmt.Sprint("key", i)
+		}
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
+		getKeyHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, context)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	atomic.StoreInt32(&down, 1)
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/"+key, strings.NewReader("value"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("X-Tdkvs-Hinted-Replicas") != "[0]" {
+		t.Fatalf("expected write to be handed off but got %v with hinted replicas %v", resp.StatusCode, resp.Header.Get("X-Tdkvs-Hinted-Replicas"))
+	}
+	if string(values2[key]) != "value" {
+		t.Fatal("expected value to be handed off to the other volume server")
+	}
+
+	// The handed off value is read from the fallback volume server
+	resp, err = http.Get(server.URL + "/get/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "value" {
+		t.Errorf("expected value but got %v", string(body))
+	}
+
+	// Hints are kept while the volume server is down
+	replayed, err := replayHints(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 0 {
+		t.Fatalf("expected no hints to be replayed but %v were", replayed)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	replayed, err = replayHints(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 {
+		t.Fatalf("expected 1 hint to be replayed but %v were", replayed)
+	}
+	if string(values1[key]) != "value" {
+		t.Error("expected value to be replayed to its volume server")
+	}
+	if _, ok := values2[key]; ok {
+		t.Error("expected handed off value to be deleted from the fallback volume server")
+	}
+
+	keys, err := listHintedKeys(context.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected no hints to be left but got %v", keys)
+	}
+}
+
+func TestRaftReplicatesWrites(t *testing.T) {
+	peers := []Peer{}
+	for i := 0; i < 3; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := listener.Addr().String()
+		listener.Close()
+		peers = append(peers, Peer{ID: fmt.Sprint("master", i), Address: address, URL: fmt.Sprint("http://master", i)})
+	}
+
+	stores := []*store{}
+	for _, peer := range peers {
+		options := badger.DefaultOptions(t.TempDir())
+		options.Logger = nil
+		db, err := badger.Open(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node, logs, err := startRaft(&RaftConfig{ID: peer.ID, Dir: t.TempDir(), Peers: peers}, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			node.Shutdown().Error()
+			logs.Close()
+			db.Close()
+		})
+
+		s := newStore(db)
+		s.raft = node
+		stores = append(stores, s)
+	}
+
+	// Wait for a leader to be elected
+	var leader *store
+	for i := 0; leader == nil && i < 100; i++ {
+		for _, s := range stores {
+			if s.raft.State() == raft.Leader {
+				leader = s
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if leader == nil {
+		t.Fatal("no raft leader was elected")
+	}
+
+	err := leader.Update(func(txn kvTxn) error {
+		return setMetakey(txn, "key0", &metakey{Volumes: []uint32{1}, Size: 4})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every master server applies the write
+	for _, s := range stores {
+		var m *metakey
+		for i := 0; i < 100; i++ {
+			m, err = lookupMetakey(&context{db: s}, "key0")
+			if err == nil {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err != nil || !sameVolumes(m.Volumes, []uint32{1}) {
+			t.Errorf("expected write to be replicated but got %v: %v", m, err)
+		}
+	}
+
+	// Followers refuse writes and redirect requests to the leader
+	for i, s := range stores {
+		if s == leader {
+			continue
+		}
+
+		err := s.Update(func(txn kvTxn) error {
+			return setMetakey(txn, "key1", &metakey{Volumes: []uint32{0}})
+		})
+		if !errors.Is(err, raft.ErrNotLeader) {
+			t.Errorf("expected follower to refuse writes but got %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		followerHandler(&RaftConfig{ID: peers[i].ID, Peers: peers}, s.raft).ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/set/key1?consistency=one", nil))
+		_, id := s.raft.LeaderWithID()
+		expected := (&RaftConfig{Peers: peers}).peer(string(id)).URL + "/set/key1?consistency=one"
+		if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != expected {
+			t.Errorf("expected redirect to %v but got %v %v", expected, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestStandbySync(t *testing.T) {
+	volume, _ := newTestVolume()
+	defer volume.Close()
+
+	primary := newTestContext(t, []string{volume.URL}, 1)
+	err := primary.db.Update(func(txn kvTxn) error {
+		return putBuckets(txn, primary.buckets)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, primary)
+	}).Methods("PUT")
+	router.HandleFunc("/delete/{key}", func(w http.ResponseWriter, r *http.Request) {
+		deleteKeyHandler(w, r, primary)
+	}).Methods("DELETE")
+	router.HandleFunc("/admin/changes", func(w http.ResponseWriter, r *http.Request) {
+		changesHandler(w, r, primary)
+	}).Methods("GET")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, key := range []string{"kept", "deleted"} {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/"+key, strings.NewReader("value of "+key))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	options := badger.DefaultOptions(t.TempDir())
+	options.Logger = nil
+	db, err := badger.Open(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	config := *primary.config
+	config.Standby = &StandbyConfig{Primary: server.URL}
+	s := newStandby(&config, newStore(db), utils.HashFNV)
+	standbyServer := httptest.NewServer(standbyHandler(s))
+	defer standbyServer.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	// Reads are redirected until the first sync
+	resp, err := client.Get(standbyServer.URL + "/get/kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("expected read before the first sync to be redirected but got %v", resp.StatusCode)
+	}
+
+	// A key that only the standby has is dropped by a full sync
+	err = s.c.db.Update(func(txn kvTxn) error {
+		return txn.Set([]byte("orphan"), []byte("orphan"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.sync(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Get(standbyServer.URL + "/get/kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "value of kept" {
+		t.Fatalf("expected standby to serve the key but got %v: %v", resp.StatusCode, string(body))
+	}
+	if resp.Header.Get("X-Tdkvs-Standby-Lag") == "" {
+		t.Fatal("expected standby to report its lag")
+	}
+	err = s.c.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("orphan"))
+		return err
+	})
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatalf("expected full sync to drop the key the primary does not have but got %v", err)
+	}
+
+	// An incremental sync applies deletes
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/delete/deleted", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	err = s.sync(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Get(standbyServer.URL + "/get/deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected deleted key to be gone from the standby but got %v", resp.StatusCode)
+	}
+
+	// Reads beyond the staleness bound and writes go to the primary
+	resp, err = client.Get(standbyServer.URL + "/get/kept?max_staleness=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || !strings.HasPrefix(resp.Header.Get("Location"), server.URL) {
+		t.Fatalf("expected stale read to be redirected to the primary but got %v", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, standbyServer.URL+"/set/kept", strings.NewReader("new value"))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("expected write to be redirected to the primary but got %v", resp.StatusCode)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	volume1, _ := newTestVolume()
+	defer volume1.Close()
+	volume2, values2 := newTestVolume()
+	defer volume2.Close()
+	volumes := []string{volume1.URL, volume2.URL}
+
+	lost := newTestContext(t, volumes, 1)
+	router := mux.NewRouter()
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, lost)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	keys := []string{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint("key", i)
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/"+key, strings.NewReader("value of "+key))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		keys = append(keys, key)
+	}
+
+	// A stray copy in the volume server a key is not placed in
+	stray := ""
+	for _, key := range keys {
+		if _, chosen := lost.chooseVolumes(key); chosen[0] == 0 {
+			stray = key
+			values2[key] = []byte("value of " + key)
+			break
+		}
+	}
+
+	c := newTestContext(t, volumes, 1)
+	found, err := rebuildIndex(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != len(keys) {
+		t.Fatalf("expected %v keys to be found but got %v", len(keys), found)
+	}
+
+	for _, key := range keys {
+		expected, err := lookupMetakey(lost, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == stray {
+			expected.Volumes = append(expected.Volumes, 1)
+		}
+
+		actual, err := lookupMetakey(c, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(actual.Volumes) != fmt.Sprint(expected.Volumes) || actual.Size != expected.Size {
+			t.Errorf("expected metakey %+v for key \"%v\" but got %+v", expected, key, actual)
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+	volumes := []string{}
+	values := []map[string][]byte{}
+	for i := 0; i < 3; i++ {
+		volume, volumeValues := newTestVolume()
+		defer volume.Close()
+		volumes = append(volumes, volume.URL)
+		values = append(values, volumeValues)
+	}
+
+	c := newTestContext(t, volumes, 2)
+	router := mux.NewRouter()
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, c)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, key := range []string{"missing", "lost", "misplaced", "fine"} {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/"+key, strings.NewReader("value of "+key))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	_, chosen := c.chooseVolumes("missing")
+	delete(values[chosen[0]], "missing")
+
+	for _, volumeValues := range values {
+		delete(volumeValues, "lost")
+	}
+
+	values[0]["orphan"] = []byte("value of orphan")
+
+	// Move a replica to the bucket placement does not choose
+	_, chosen = c.chooseVolumes("misplaced")
+	other := uint32(0)
+	for other == chosen[0] || other == chosen[1] {
+		other++
+	}
+	delete(values[chosen[1]], "misplaced")
+	values[other]["misplaced"] = []byte("value of misplaced")
+	err := c.db.Update(func(txn kvTxn) error {
+		return setMetakey(txn, "misplaced", &metakey{Volumes: []uint32{chosen[0], other}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := runFsck(c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.scanned != 4 || len(report.missing) != 1 || len(report.lost) != 1 || len(report.orphans) != 1 || len(report.misplaced) != 1 {
+		t.Fatalf("expected one of every inconsistency in 4 keys but got %+v", report)
+	}
+	if report.missing[0].key != "missing" || report.lost[0].key != "lost" || report.orphans[0].key != "orphan" || report.misplaced[0].key != "misplaced" {
+		t.Fatalf("expected inconsistencies of the keys they are named after but got %+v", report)
+	}
+
+	_, err = runFsck(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = runFsck(c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.scanned != 3 || len(report.missing) != 0 || len(report.lost) != 0 || len(report.orphans) != 0 || len(report.misplaced) != 0 {
+		t.Fatalf("expected no inconsistencies after repairing but got %+v", report)
+	}
+	if _, ok := values[other]["misplaced"]; ok {
+		t.Error("expected misplaced key to be moved to the buckets placement chooses")
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	volumes := []string{}
+	values := []map[string][]byte{}
+	for i := 0; i < 2; i++ {
+		volume, volumeValues := newTestVolume()
+		defer volume.Close()
+		volumes = append(volumes, volume.URL)
+		values = append(values, volumeValues)
+	}
+
+	c := newTestContext(t, volumes, 1)
+	c.config.GCGrace = 3600
+	router := mux.NewRouter()
+	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
+		setKeyHandler(w, r, c)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/set/"+key, strings.NewReader("value of "+key))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// A write of "handed" that was handed off to the other volume server
+	_, chosen := c.chooseVolumes("handed")
+	fallback := volumes[1-chosen[0]]
+	values[1-chosen[0]]["handed"] = []byte("value of handed")
+	err := c.db.Update(func(txn kvTxn) error {
+		err := setMetakey(txn, "handed", &metakey{Volumes: chosen})
+		if err != nil {
+			return err
+		}
+		return putHints(txn, "handed", []hint{{Bucket: chosen[0], Volume: volumes[chosen[0]], Fallback: fallback, Hash: c.hash("handed")}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values[0]["orphan"] = []byte("value of orphan")
+	values[1]["orphan"] = []byte("value of orphan")
+
+	results, err := collectGarbage(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := 0
+	for _, result := range results {
+		if result.Error != "" {
+			t.Fatalf("expected garbage to be collected in volume server %v but got %v", result.Volume, result.Error)
+		}
+		deleted += result.Deleted
+	}
+	if deleted != 2 {
+		t.Fatalf("expected 2 orphaned values to be deleted but got %v", deleted)
+	}
+
+	for i, volumeValues := range values {
+		if _, ok := volumeValues["orphan"]; ok {
+			t.Errorf("expected orphaned value to be deleted from volume server %v", i)
+		}
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		_, chosen := c.chooseVolumes(key)
+		if _, ok := values[chosen[0]][key]; !ok {
+			t.Errorf("expected key \"%v\" to be kept", key)
+		}
+	}
+	if _, ok := values[1-chosen[0]]["handed"]; !ok {
+		t.Error("expected handed off value to be kept in its fallback volume server")
+	}
+
+	c.mu.Lock()
+	c.rebalancing = true
+	c.mu.Unlock()
+	_, err = collectGarbage(c)
+	if !errors.Is(err, errGCBusy) {
+		t.Fatalf("expected no garbage collection while rebalancing but got %v", err)
+	}
+}
+
+func TestFsckPartialValues(t *testing.T) {
+	// Volume server whose values were stored without metadata, so it only
+	// lists the first 10 characters of their keys
+	router := mux.NewRouter()
+	router.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Tdkvs-Count")
+		for _, key := range []string{"a long key stored before metadata", "an orphan without metadata"} {
+			json.NewEncoder(w).Encode(volumeKey{Key: key[:10], Hash: fmt.Sprint(utils.HashString(key)), Size: 5, Partial: true})
+		}
+		w.Header().Set("X-Tdkvs-Count", "2")
+	}).Methods("GET")
+	volume := httptest.NewServer(router)
+	defer volume.Close()
+
+	c := newTestContext(t, []string{volume.URL}, 1)
+	err := c.db.Update(func(txn kvTxn) error {
+		return setMetakey(txn, "a long key stored before metadata", &metakey{Volumes: []uint32{0}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := runFsck(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.missing) != 0 || len(report.lost) != 0 || len(report.orphans) != 0 || report.unknown != 1 {
+		t.Fatalf("expected the long key to match its value and the other value to be unknown but got %+v", report)
+	}
+
+	_, err = lookupMetakey(c, "a long key stored before metadata")
+	if err != nil {
+		t.Fatalf("expected metakey of the long key to be kept but got %v", err)
+	}
+}
+
+func TestBadgerInUse(t *testing.T) {
+	dir := t.TempDir()
+	options := badger.DefaultOptions(dir)
+	options.Logger = nil
+	db, err := badger.Open(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = badger.Open(options)
+	if !inUse(err) {
+		t.Fatalf("expected BadgerDB to be in use but got %v", err)
+	}
+}
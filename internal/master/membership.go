@@ -0,0 +1,135 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Return the volume servers that hold buckets but are not in the config,
+// i.e. because they were removed from it or their url changed
+func missingVolumes(buckets []string, urls []string) []string {
+	missing := []string{}
+	for _, url := range buckets {
+		if !containsVolume(urls, url) && !containsVolume(missing, url) {
+			missing = append(missing, url)
+		}
+	}
+	return missing
+}
+
+// Return the volume servers in the config that hold no buckets yet
+func newVolumes(buckets []string, urls []string) []string {
+	added := []string{}
+	for _, url := range urls {
+		if !containsVolume(buckets, url) {
+			added = append(added, url)
+		}
+	}
+	return added
+}
+
+// Check if the volume servers in the config are listed in another order
+// than their first buckets
+func reordered(buckets []string, urls []string) bool {
+	order := []string{}
+	for _, url := range buckets {
+		if containsVolume(urls, url) && !containsVolume(order, url) {
+			order = append(order, url)
+		}
+	}
+
+	i := 0
+	for _, url := range urls {
+		if i < len(order) && containsVolume(order, url) {
+			if order[i] != url {
+				return true
+			}
+			i++
+		}
+	}
+	return false
+}
+
+// Explain how to reconcile volume servers that hold buckets but are not in
+// the config
+func membershipError(missing []string, added []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "volume servers %v hold keys but are not in the config yaml file. Either:\n", strings.Join(missing, ", "))
+	fmt.Fprintln(&b, "  - add them back to the config yaml file")
+	if len(added) > 0 {
+		fmt.Fprintf(&b, "  - run the master server with -rename=%v=%v if a volume server moved to another url\n", missing[0], added[0])
+	}
+	fmt.Fprint(&b, "  - run the master server with -reconcile to decommission them")
+	return errors.New(b.String())
+}
+
+// Point the buckets of volume servers whose url changed to their new urls,
+// and persist the bucket table, the labels of the keys and the volume ids
+// The volume servers at the new urls must hold the same values, which is
+// verified by their volume ids
+func renameVolumes(db *store, buckets []string, renames map[string]string, urls []string) ([]string, error) {
+	job, err := getRebalanceJob(db)
+	if err != nil {
+		return nil, err
+	}
+	if job != nil && job.Retiring != nil {
+		return nil, fmt.Errorf("bucket %v of volume server %v is being retired. Finish its decommission before renaming volume servers", job.Retiring.Bucket, job.Retiring.Volume)
+	}
+
+	renamed := append([]string{}, buckets...)
+	for from, to := range renames {
+		if !containsVolume(buckets, from) {
+			return nil, fmt.Errorf("volume server %v holds no buckets", from)
+		}
+		if containsVolume(buckets, to) {
+			return nil, fmt.Errorf("volume server %v already holds buckets", to)
+		}
+		if !containsVolume(urls, to) {
+			return nil, fmt.Errorf("volume server %v is not in the config yaml file", to)
+		}
+
+		for i, url := range renamed {
+			if url == from {
+				renamed[i] = to
+			}
+		}
+	}
+
+	// Keys were placed with the labels of the old urls
+	l, err := getLabels(db)
+	if err != nil {
+		return nil, err
+	}
+	for from, to := range renames {
+		if old, ok := l[from]; ok {
+			l[to] = old
+			delete(l, from)
+		}
+	}
+
+	// The volume servers at the new urls must have the same volume ids
+	identities, err := getIdentities(db)
+	if err != nil {
+		return nil, err
+	}
+	for from, to := range renames {
+		if id, ok := identities[from]; ok {
+			identities[to] = id
+			delete(identities, from)
+		}
+	}
+
+	err = db.Update(func(txn kvTxn) error {
+		err := putBuckets(txn, renamed)
+		if err != nil {
+			return err
+		}
+		err = putLabels(txn, l)
+		if err != nil {
+			return err
+		}
+		return putIdentities(txn, identities)
+	})
+	return renamed, err
+}
@@ -0,0 +1,140 @@
+package master
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Value stored in BadgerDB for every key
+type metakey struct {
+	Volumes []uint32 `json:"volumes"`        // Volume servers holding a replica of the key
+	Size    int64    `json:"size,omitempty"` // Size of the value in bytes. Zero if it is not known
+}
+
+// Decode a metakey value
+// Metakeys written before replication was supported hold a single
+// big endian volume number, so they are decoded as a single replica
+func decodeMetakey(v []byte) (*metakey, error) {
+	if len(v) == 4 {
+		return &metakey{Volumes: []uint32{binary.BigEndian.Uint32(v)}}, nil
+	}
+
+	m := &metakey{}
+	err := json.Unmarshal(v, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Encode a metakey value
+func (m *metakey) encode() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Check if the key has a replica in the given volume server
+func (m *metakey) hasVolume(volume uint32) bool {
+	for _, v := range m.Volumes {
+		if v == volume {
+			return true
+		}
+	}
+	return false
+}
+
+// Retrieve the metakey of a key
+func getMetakey(txn kvTxn, key string) (*metakey, error) {
+	item, err := txn.Get([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	var m *metakey
+	err = item.Value(func(v []byte) error {
+		m, err = decodeMetakey(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Retrieve the metakey of a key in its own transaction
+func lookupMetakey(c *context, key string) (*metakey, error) {
+	var m *metakey
+	err := c.db.View(func(txn *badger.Txn) error {
+		var err error
+		m, err = getMetakey(txn, key)
+		return err
+	})
+	return m, err
+}
+
+// Set the metakey of a key
+func setMetakey(txn kvTxn, key string, m *metakey) error {
+	value, err := m.encode()
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(key), value)
+}
+
+// Read a meta number (i.e. _meta_num_volumes)
+// Returns badger.ErrKeyNotFound if it was never set
+func getMetaNumber(db *store, key string) (int, error) {
+	var number int
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			number = int(binary.BigEndian.Uint32(v))
+			return nil
+		})
+	})
+	return number, err
+}
+
+// Set a meta number (i.e. _meta_num_volumes)
+func setMetaNumber(db *store, key string, number int) error {
+	return db.Update(func(txn kvTxn) error {
+		return putMetaNumber(txn, key, number)
+	})
+}
+
+// Set a meta number in a transaction
+func putMetaNumber(txn kvTxn, key string, number int) error {
+	var numberBytes [4]byte
+	binary.BigEndian.PutUint32(numberBytes[0:4], uint32(number))
+	return txn.Set([]byte(key), numberBytes[:])
+}
+
+// Read a meta string (i.e. _meta_placement)
+// Returns badger.ErrKeyNotFound if it was never set
+func getMetaString(db *store, key string) (string, error) {
+	var value string
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			value = string(v)
+			return nil
+		})
+	})
+	return value, err
+}
+
+// Set a meta string (i.e. _meta_placement)
+func setMetaString(db *store, key string, value string) error {
+	return db.Update(func(txn kvTxn) error {
+		return txn.Set([]byte(key), []byte(value))
+	})
+}
@@ -0,0 +1,272 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/orellazri/tdkvs/internal/utils"
+)
+
+// Prefix of the journal entries of keys that are being moved
+const migrationPrefix = "_meta_migration_"
+
+// Journal entry of a key that is being moved between volume servers
+// It is written before anything is copied, so an interrupted move can
+// always be resumed without losing the value
+type migration struct {
+	Key     string   `json:"key"`
+	Hash    uint64   `json:"hash"`
+	NewHash *uint64  `json:"new_hash,omitempty"` // Hash of the key after the move, if the key is rehashed
+	From    []uint32 `json:"from"`               // Volume servers holding the key before the move
+	To      []uint32 `json:"to"`                 // Volume servers holding the key after the move
+	Copied  bool     `json:"copied"`             // Whether the value was copied and the metakey points to the new volume servers
+}
+
+// Check if the key is stored under a new hash after the move
+func (mig *migration) rehashed() bool {
+	return mig.NewHash != nil && *mig.NewHash != mig.Hash
+}
+
+// Return the hash of the key after the move
+func (mig *migration) toHash() uint64 {
+	if mig.NewHash != nil {
+		return *mig.NewHash
+	}
+	return mig.Hash
+}
+
+// Write a journal entry in a transaction
+func setMigration(txn kvTxn, mig *migration) error {
+	value, err := json.Marshal(mig)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(migrationPrefix+mig.Key), value)
+}
+
+// Move a key from one set of volume servers to another
+// The value is copied to the new volume servers and verified there, then
+// the metakey is updated, and only then the value is deleted from the
+// volume servers that are not in the new set
+func migrateKey(c *context, key string, hash uint64, from []uint32, to []uint32) error {
+	mig := &migration{
+		Key:  key,
+		Hash: hash,
+		From: from,
+		To:   to,
+	}
+
+	err := c.db.Update(func(txn kvTxn) error {
+		return setMigration(txn, mig)
+	})
+	if err != nil {
+		return err
+	}
+
+	return runMigration(c, mig)
+}
+
+// Run the remaining steps of a journaled move
+func runMigration(c *context, mig *migration) error {
+	if !mig.Copied {
+		size, err := copyKey(c, mig)
+		if err != nil {
+			return err
+		}
+
+		// Point the metakey to the new volume servers and mark the copy as done
+		// in the same transaction
+		// A key that was deleted while it was being moved is not recreated
+		mig.Copied = true
+		deleted := false
+		err = c.db.Update(func(txn kvTxn) error {
+			m, err := getMetakey(txn, mig.Key)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				deleted = true
+				return txn.Delete([]byte(migrationPrefix + mig.Key))
+			} else if err != nil {
+				return err
+			}
+
+			m.Volumes = mig.To
+			if size > 0 {
+				m.Size = int64(size)
+			}
+			err = setMetakey(txn, mig.Key, m)
+			if err != nil {
+				return err
+			}
+			return setMigration(txn, mig)
+		})
+		if err != nil {
+			return err
+		}
+
+		if deleted {
+			log.Printf("Key \"%v\" was deleted while it was being moved. Deleting its copies", mig.Key)
+			for _, url := range c.writeVolumes(mig.To) {
+				err := deleteFromVolume(url, mig.Key, mig.toHash())
+				if err != nil {
+					log.Printf("Could not delete copy of key \"%v\" from volume server %v: %v", mig.Key, url, err)
+				}
+			}
+			return nil
+		}
+	}
+
+	// Delete key from volume servers that are not in the new set. A rehashed
+	// key is stored under another path, so it is deleted from all of them
+	stale := c.staleVolumes(mig.From, mig.To)
+	if mig.rehashed() {
+		stale = c.bucketVolumes(mig.From)
+	}
+	for _, url := range stale {
+		err := deleteFromVolume(url, mig.Key, mig.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Move is done
+	return c.db.Update(func(txn kvTxn) error {
+		return txn.Delete([]byte(migrationPrefix + mig.Key))
+	})
+}
+
+// Copy the value of a key to the volume servers that don't have it yet
+// Buckets of the same volume server share the value, so it is only copied
+// between different volume servers, unless the key is rehashed
+// Returns the size of the value, or zero if nothing had to be copied
+func copyKey(c *context, mig *migration) (int, error) {
+	sources, err := c.readVolumes(mig.Key, mig.From)
+	if err != nil {
+		return 0, err
+	}
+
+	size := 0
+	for _, destination := range c.writeVolumes(mig.To) {
+		if containsVolume(sources, destination) && !mig.rehashed() {
+			continue
+		}
+
+		size, err = copyValue(c, mig.Key, mig.Hash, sources, destination, mig.toHash())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
+
+// Copy the value of a key from one of the given volume servers to another,
+// where it is stored under the destination hash, and verify its checksum
+// there
+// Returns the size of the value
+func copyValue(c *context, key string, hash uint64, sources []string, destination string, destinationHash uint64) (int, error) {
+	size, checksum, err := transferValue(c, key, hash, sources, destination, destinationHash)
+	if err != nil {
+		return 0, err
+	}
+
+	// Verify the value was stored correctly
+	actual, err := checksumFromVolume(destination, key, destinationHash)
+	if err != nil {
+		return 0, err
+	}
+	if actual != checksum {
+		return 0, fmt.Errorf("checksum of key \"%v\" in volume server %v does not match", key, destination)
+	}
+
+	return size, nil
+}
+
+// Copy the value of a key to a volume server
+// The value is pushed directly from one of the given volume servers, and
+// is relayed through the master server only if none of them could push it
+// Returns the size and checksum of the value
+func transferValue(c *context, key string, hash uint64, sources []string, destination string, destinationHash uint64) (int, string, error) {
+	// The value crosses the network once. Its size is reserved before it is
+	// pushed, so workers that push at the same time stay within the bandwidth.
+	// Values whose size is not known are charged once they were pushed
+	reserved := 0
+	if m, err := lookupMetakey(c, key); err == nil {
+		reserved = int(m.Size)
+	}
+	c.throttle.wait(reserved)
+
+	for _, source := range sources {
+		size, checksum, err := pushFromVolume(source, key, hash, destination, destinationHash)
+		if err == nil {
+			if size > reserved {
+				c.throttle.wait(size - reserved)
+			}
+			return size, checksum, nil
+		}
+		log.Printf("Volume server %v could not push key \"%v\" to volume server %v: %v", source, key, destination, err)
+	}
+
+	// Get value from a current volume server and set it in the new one
+	var value []byte
+	err := errors.New("key has no replicas to copy from")
+	for _, source := range sources {
+		value, err = getFromVolume(source, key, hash, "raw")
+		if err == nil {
+			break
+		}
+		log.Printf("Could not get key \"%v\" from volume server %v: %v", key, source, err)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	// The value crossed the network twice
+	c.throttle.wait(2 * len(value))
+
+	err = setInVolume(destination, key, destinationHash, value)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(value), utils.Checksum(value), nil
+}
+
+// Resume moves that were interrupted, i.e. by a crash of the master server
+func resumeMigrations(c *context) error {
+	var migrations []*migration
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(migrationPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				mig := &migration{}
+				err := json.Unmarshal(v, mig)
+				if err != nil {
+					return err
+				}
+				migrations = append(migrations, mig)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range migrations {
+		log.Printf("Resuming interrupted move of key \"%v\" to volume servers %v", mig.Key, mig.To)
+		err := runMigration(c, mig)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package master
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Copy of keys from a volume server to another
+type move struct {
+	from string
+	to   string
+}
+
+// Keys and bytes that a rebalance would move, computed without touching
+// any volume server
+type plan struct {
+	volumes      []string       // Urls of the volume servers in the bucket table or in metakeys
+	scanned      int            // Amount of keys scanned
+	moving       int            // Amount of keys that would be moved
+	keys         map[move]int   // Amount of keys copied between volume servers
+	bytes        map[move]int64 // Amount of bytes copied between volume servers
+	unknownSizes int            // Amount of copies whose size is not known
+	deleted      map[string]int // Amount of replicas deleted from every volume server
+}
+
+// Compute the keys that would be moved by rebalancing to the volume servers
+// in the config
+// Buckets of the same volume server share their values, so only keys that
+// change volume servers are counted. Buckets of volume servers whose weight
+// was lowered, or that were dropped from the config, are retired first, so
+// keys are placed in the bucket table that is left once they are
+func computePlan(c *context) (*plan, error) {
+	p := &plan{
+		keys:    make(map[move]int),
+		bytes:   make(map[move]int64),
+		deleted: make(map[string]int),
+	}
+
+	table := c.volumes()
+	retired := retiredBuckets(c)
+	addVolumes := func(urls []string) {
+		for _, url := range urls {
+			if !containsVolume(p.volumes, url) {
+				p.volumes = append(p.volumes, url)
+			}
+		}
+	}
+	addVolumes(table)
+	addVolumes(retired)
+
+	last := ""
+	for {
+		entries, err := nextKeys(c.db, last, rebalanceBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			p.scanned++
+
+			// Metakeys may point to buckets that are not in the bucket table anymore
+			current := planURLs(table, entry.m.Volumes)
+			addVolumes(current)
+
+			_, chosen := c.chooseBuckets(retired, entry.key)
+			next := planURLs(retired, chosen)
+			if sameURLs(current, next) {
+				continue
+			}
+			p.moving++
+
+			// Values are copied from the first current replica
+			source := current[0]
+			for _, url := range next {
+				if containsVolume(current, url) {
+					continue
+				}
+				p.keys[move{source, url}]++
+				if entry.m.Size > 0 {
+					p.bytes[move{source, url}] += entry.m.Size
+				} else {
+					p.unknownSizes++
+				}
+			}
+			for _, url := range current {
+				if !containsVolume(next, url) {
+					p.deleted[url]++
+				}
+			}
+		}
+
+		last = entries[len(entries)-1].key
+	}
+
+	return p, nil
+}
+
+// Return the bucket table once every bucket that has to be retired is,
+// starting with the retirement in progress, if any
+// A retired bucket is remapped to the volume server that takes it over,
+// and the last bucket is removed if it is drained
+func retiredBuckets(c *context) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	buckets := append([]string{}, c.buckets...)
+	r := c.retiring
+	if r == nil {
+		r = nextRetirement(buckets, c.weights, c.spares)
+	}
+	for r != nil {
+		if !r.Remapped {
+			buckets[r.Bucket] = r.To
+		}
+		if r.Drain {
+			buckets = buckets[:len(buckets)-1]
+		}
+		r = nextRetirement(buckets, c.weights, c.spares)
+	}
+	return buckets
+}
+
+// Return the urls of the volume servers of the given buckets, without
+// duplicates. Buckets that are not in the bucket table are named after
+// their number
+func planURLs(table []string, buckets []uint32) []string {
+	urls := []string{}
+	for _, bucket := range buckets {
+		url := fmt.Sprintf("(bucket %v, not in config)", bucket)
+		if int(bucket) < len(table) {
+			url = table[bucket]
+		}
+		if !containsVolume(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// Check if two lists of urls without duplicates contain the same urls
+func sameURLs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, url := range a {
+		if !containsVolume(b, url) {
+			return false
+		}
+	}
+	return true
+}
+
+// Print a plan as a movement matrix and a summary for every volume server
+func printPlan(w io.Writer, p *plan, replicas int) {
+	fmt.Fprintf(w, "Rebalancing %v volume servers with %v replicas\n", len(p.volumes), replicas)
+	fmt.Fprintf(w, "%v of %v keys would be moved\n", p.moving, p.scanned)
+	if p.unknownSizes > 0 {
+		fmt.Fprintf(w, "The size of %v copies is not known and is not included in the byte totals\n", p.unknownSizes)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Keys (bytes) copied from a volume server (rows) to another (columns), by index:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "from \\ to\t")
+	for to := range p.volumes {
+		fmt.Fprintf(tw, "%v\t", to)
+	}
+	fmt.Fprintln(tw)
+	for from, fromURL := range p.volumes {
+		fmt.Fprintf(tw, "%v\t", from)
+		for to, toURL := range p.volumes {
+			if from == to {
+				fmt.Fprint(tw, "-\t")
+			} else {
+				m := move{fromURL, toURL}
+				fmt.Fprintf(tw, "%v (%v)\t", p.keys[m], p.bytes[m])
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Volume servers:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "index\turl\tkeys in\tbytes in\tkeys out\tbytes out\treplicas deleted\t")
+	for i, url := range p.volumes {
+		keysIn, keysOut := 0, 0
+		var bytesIn, bytesOut int64
+		for _, other := range p.volumes {
+			in := move{other, url}
+			out := move{url, other}
+			keysIn += p.keys[in]
+			bytesIn += p.bytes[in]
+			keysOut += p.keys[out]
+			bytesOut += p.bytes[out]
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", i, url, keysIn, bytesIn, keysOut, bytesOut, p.deleted[url])
+	}
+	tw.Flush()
+}
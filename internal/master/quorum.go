@@ -0,0 +1,185 @@
+package master
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Consistency levels that can be requested for reads and writes
+const (
+	ConsistencyOne    = "one"
+	ConsistencyQuorum = "quorum"
+	ConsistencyAll    = "all"
+)
+
+// Get the consistency level of a request from the `consistency` query parameter
+// or the X-Consistency header, falling back to the given default level
+func requestConsistency(r *http.Request, fallback string) (string, error) {
+	level := r.URL.Query().Get("consistency")
+	if level == "" {
+		level = r.Header.Get("X-Consistency")
+	}
+	if level == "" {
+		level = fallback
+	}
+
+	if !isConsistencyLevel(level) {
+		return "", fmt.Errorf("invalid consistency level \"%v\". Expected one, quorum or all", level)
+	}
+	return level, nil
+}
+
+// Check if a string is a valid consistency level
+func isConsistencyLevel(level string) bool {
+	switch level {
+	case ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return true
+	default:
+		return false
+	}
+}
+
+// Return the number of replicas that must respond for a consistency level
+func requiredReplicas(level string, replicas int) int {
+	switch level {
+	case ConsistencyOne:
+		return 1
+	case ConsistencyQuorum:
+		return replicas/2 + 1
+	default:
+		return replicas
+	}
+}
+
+// Run a request against every given volume server in parallel
+// Returns the volume servers that succeeded, in the order they were given,
+// and the errors of the ones that failed
+func fanOut(volumes []uint32, request func(numVolume uint32) error) ([]uint32, map[uint32]error) {
+	errs := make([]error, len(volumes))
+
+	var wg sync.WaitGroup
+	for i, numVolume := range volumes {
+		wg.Add(1)
+		go func(i int, numVolume uint32) {
+			defer wg.Done()
+			errs[i] = request(numVolume)
+		}(i, numVolume)
+	}
+	wg.Wait()
+
+	succeeded := []uint32{}
+	failed := make(map[uint32]error)
+	for i, numVolume := range volumes {
+		if errs[i] != nil {
+			failed[numVolume] = errs[i]
+		} else {
+			succeeded = append(succeeded, numVolume)
+		}
+	}
+	return succeeded, failed
+}
+
+// Return the volume servers of failed requests in ascending order
+func failedVolumes(failed map[uint32]error) []uint32 {
+	volumes := []uint32{}
+	for numVolume := range failed {
+		volumes = append(volumes, numVolume)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i] < volumes[j] })
+	return volumes
+}
+
+// Result of reading a key from its replicas
+type readResult struct {
+	value     []byte   // Value returned by the most replicas
+	succeeded []uint32 // Volume servers that returned the value
+	failed    []uint32 // Volume servers that failed
+	conflict  bool     // Whether the replicas returned different values
+}
+
+// Read a key from its replicas with the given consistency level
+// With consistency level one, the replicas are tried in order until one of
+// them responds, starting with the ones of healthy volume servers.
+// Otherwise, all replicas are read in parallel. Replicas that were handed
+// off are read from their fallback volume servers
+func readReplicas(c *context, key string, hash uint64, as string, volumes []uint32, consistency string) (*readResult, error) {
+	urls := c.volumes()
+
+	hints, err := lookupHints(c.db, key)
+	if err != nil {
+		return nil, err
+	}
+	get := func(numVolume uint32) ([]byte, error) {
+		if h := hintFor(hints, numVolume); h != nil {
+			return getFromVolume(h.Fallback, key, h.Hash, as)
+		}
+		return getFromVolume(urls[numVolume], key, hash, as)
+	}
+
+	if consistency == ConsistencyOne {
+		volumes = c.health.order(urls, volumes)
+		for i, numVolume := range volumes {
+			value, err := get(numVolume)
+			if err != nil {
+				log.Printf("Could not get key \"%v\" from volume server %v: %v", key, numVolume, err)
+				continue
+			}
+
+			return &readResult{value: value, succeeded: []uint32{numVolume}, failed: volumes[:i]}, nil
+		}
+
+		return nil, fmt.Errorf("none of the %v replicas responded", len(volumes))
+	}
+
+	values := make([][]byte, len(urls))
+	succeeded, failed := fanOut(volumes, func(numVolume uint32) error {
+		value, err := get(numVolume)
+		values[numVolume] = value
+		return err
+	})
+	for numVolume, err := range failed {
+		log.Printf("Could not get key \"%v\" from volume server %v: %v", key, numVolume, err)
+	}
+
+	required := requiredReplicas(consistency, len(volumes))
+	if len(succeeded) < required {
+		return nil, fmt.Errorf("could only be read from %v of %v replicas (%v required)", len(succeeded), len(volumes), required)
+	}
+
+	responses := [][]byte{}
+	for _, numVolume := range succeeded {
+		responses = append(responses, values[numVolume])
+	}
+	value, agreed := majorityValue(responses)
+
+	return &readResult{value: value, succeeded: succeeded, failed: failedVolumes(failed), conflict: !agreed}, nil
+}
+
+// Choose the value returned by the most replicas
+// Returns the value and whether all replicas agreed on it
+func majorityValue(values [][]byte) ([]byte, bool) {
+	var best []byte
+	bestCount := 0
+	for _, value := range values {
+		count := 0
+		for _, other := range values {
+			if bytes.Equal(value, other) {
+				count++
+			}
+		}
+		if count > bestCount {
+			best = value
+			bestCount = count
+		}
+	}
+	return best, bestCount == len(values)
+}
+
+// Report how many replicas acknowledged a request
+func setReplicasHeader(w http.ResponseWriter, acked int, total int) {
+	w.Header().Set("X-Tdkvs-Replicas", fmt.Sprintf("%v/%v", acked, total))
+}
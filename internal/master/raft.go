@@ -0,0 +1,350 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// Time to wait for a write to be replicated to a quorum of master servers
+const raftApplyTimeout = 10 * time.Second
+
+// Raft config of a master server that replicates its metadata to other
+// master servers
+type RaftConfig struct {
+	ID    string // Id of this master server. Must be one of the peers
+	Dir   string // Optional. Directory of the raft log and snapshots (defaults to raft)
+	Peers []Peer // Every master server in the cluster, including this one
+}
+
+// Master server in a raft cluster
+type Peer struct {
+	ID      string `json:"id"`      // Id of the master server
+	Address string `json:"address"` // Address the master server listens on for raft (host:port)
+	URL     string `json:"url"`     // Url of the master server, which the other master servers redirect requests to
+}
+
+// Return the peer with the given id, or nil if there is none
+func (config *RaftConfig) peer(id string) *Peer {
+	for i := range config.Peers {
+		if config.Peers[i].ID == id {
+			return &config.Peers[i]
+		}
+	}
+	return nil
+}
+
+// Write of a replicated transaction
+type raftOp struct {
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// Transaction whose writes are recorded to be replicated
+// Writes are also applied to the underlying BadgerDB transaction, which
+// is discarded, so the transaction reads its own writes
+type raftTxn struct {
+	*badger.Txn
+	ops []raftOp
+}
+
+// Set a key in the transaction
+func (txn *raftTxn) Set(key []byte, val []byte) error {
+	err := txn.Txn.Set(key, val)
+	if err != nil {
+		return err
+	}
+	txn.ops = append(txn.ops, raftOp{Key: append([]byte{}, key...), Value: append([]byte{}, val...)})
+	return nil
+}
+
+// Delete a key in the transaction
+func (txn *raftTxn) Delete(key []byte) error {
+	err := txn.Txn.Delete(key)
+	if err != nil {
+		return err
+	}
+	txn.ops = append(txn.ops, raftOp{Key: append([]byte{}, key...), Delete: true})
+	return nil
+}
+
+// Run a read-write transaction and replicate its writes
+// The writes are applied to the BadgerDB of every master server, including
+// this one, only once a quorum of master servers stored them. Transactions
+// are serialized, since their reads are not checked for conflicts when
+// their writes are applied
+// Returns raft.ErrNotLeader if this master server is not the leader
+func (s *store) replicate(fn func(txn kvTxn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txn := &raftTxn{Txn: s.DB.NewTransaction(true)}
+	defer txn.Discard()
+
+	err := fn(txn)
+	if err != nil {
+		return err
+	}
+	if len(txn.ops) == 0 {
+		return nil
+	}
+
+	cmd, err := json.Marshal(txn.ops)
+	if err != nil {
+		return err
+	}
+
+	future := s.raft.Apply(cmd, raftApplyTimeout)
+	err = future.Error()
+	if err != nil {
+		return err
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Applies replicated writes to the BadgerDB of a master server
+type raftFSM struct {
+	db *badger.DB
+}
+
+// Apply the writes of a replicated transaction
+func (f *raftFSM) Apply(l *raft.Log) interface{} {
+	ops := []raftOp{}
+	err := json.Unmarshal(l.Data, &ops)
+	if err != nil {
+		return err
+	}
+
+	return f.db.Update(func(txn *badger.Txn) error {
+		for _, op := range ops {
+			var err error
+			if op.Delete {
+				err = txn.Delete(op.Key)
+			} else {
+				err = txn.Set(op.Key, op.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Take a snapshot of the BadgerDB
+// The backup is taken when the snapshot is persisted, so it may contain
+// writes of later log entries. Those entries are replayed on top of it,
+// which is harmless since writes only set and delete keys
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return &raftSnapshot{f.db}, nil
+}
+
+// Replace the BadgerDB with a snapshot
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	err := f.db.DropAll()
+	if err != nil {
+		return err
+	}
+	return f.db.Load(rc, 256)
+}
+
+// Snapshot of the BadgerDB of a master server
+type raftSnapshot struct {
+	db *badger.DB
+}
+
+// Write a backup of the BadgerDB to the snapshot
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	_, err := s.db.Backup(sink, 0)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release the snapshot
+func (s *raftSnapshot) Release() {}
+
+// Start the raft node of a master server over its BadgerDB
+// A master server without raft state bootstraps the cluster with all of
+// its peers. Every peer bootstraps the same cluster, so they may start in
+// any order
+func startRaft(config *RaftConfig, db *badger.DB) (*raft.Raft, *raftLogStore, error) {
+	self := config.peer(config.ID)
+	if self == nil {
+		return nil, nil, fmt.Errorf("raft id %v is not one of the peers", config.ID)
+	}
+	if config.Dir == "" {
+		config.Dir = "raft"
+	}
+
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logs, err := openRaftLogStore(filepath.Join(config.Dir, "log"))
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(config.Dir, 2, os.Stderr)
+	if err != nil {
+		logs.Close()
+		return nil, nil, err
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", self.Address)
+	if err != nil {
+		logs.Close()
+		return nil, nil, err
+	}
+	transport, err := raft.NewTCPTransport(self.Address, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		logs.Close()
+		return nil, nil, err
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.ID)
+	raftConfig.LogLevel = "WARN"
+
+	node, err := raft.NewRaft(raftConfig, &raftFSM{db}, logs, logs, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, nil, err
+	}
+
+	existing, err := raft.HasExistingState(logs, logs, snapshots)
+	if err != nil {
+		// Shutting raft down closes its transport too
+		node.Shutdown().Error()
+		logs.Close()
+		return nil, nil, err
+	}
+	if !existing {
+		servers := []raft.Server{}
+		for _, peer := range config.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(peer.ID), Address: raft.ServerAddress(peer.Address)})
+		}
+		err := node.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			node.Shutdown().Error()
+			logs.Close()
+			return nil, nil, err
+		}
+	}
+
+	return node, logs, nil
+}
+
+// Wait until this master server is the raft leader and has applied every
+// write that was committed before it became the leader
+func waitForLeadership(node *raft.Raft) error {
+	leader := raft.ServerID("")
+	for node.State() != raft.Leader {
+		_, id := node.LeaderWithID()
+		if id != leader && id != "" {
+			log.Printf("Master server %v is the raft leader. Redirecting requests to it", id)
+		}
+		leader = id
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	log.Println("This master server is the raft leader")
+	return node.Barrier(0).Error()
+}
+
+// Stop the master server once it is no longer the raft leader
+// Rebalances and other background work only run in the leader, so the
+// master server exits instead of stopping them. Restart it to rejoin the
+// cluster as a follower
+func watchLeadership(node *raft.Raft) {
+	for leader := range node.LeaderCh() {
+		if !leader {
+			log.Fatal("This master server is no longer the raft leader. Exiting")
+		}
+	}
+}
+
+// Raft state of a master server as reported by the admin API
+type raftStatus struct {
+	ID     string `json:"id"`
+	State  string `json:"state"`
+	Leader string `json:"leader"` // Id of the leader. Empty if there is none
+	Peers  []Peer `json:"peers"`
+}
+
+// Handle reporting the raft state of a master server
+func raftStatusHandler(w http.ResponseWriter, r *http.Request, config *RaftConfig, node *raft.Raft) {
+	_, leader := node.LeaderWithID()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(raftStatus{
+		ID:     config.ID,
+		State:  node.State().String(),
+		Leader: string(leader),
+		Peers:  config.Peers,
+	})
+}
+
+// Handler of a master server that is not the raft leader
+// Requests are redirected to the leader, which serves all of them, so
+// clients always see the latest metadata
+func followerHandler(config *RaftConfig, node *raft.Raft) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/raft" {
+			raftStatusHandler(w, r, config, node)
+			return
+		}
+
+		_, id := node.LeaderWithID()
+		leader := config.peer(string(id))
+		if leader == nil || id == raft.ServerID(config.ID) {
+			http.Error(w, "There is no raft leader", http.StatusServiceUnavailable)
+			return
+		}
+
+		// Temporary redirects keep the method and body of the request
+		http.Redirect(w, r, leader.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+// Handler that can be swapped while the server is running, i.e. when the
+// master server becomes the raft leader
+type swapHandler struct {
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+// Serve a request with the current handler
+func (h *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	handler := h.handler
+	h.mu.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+// Replace the handler
+func (h *swapHandler) swap(handler http.Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handler = handler
+}
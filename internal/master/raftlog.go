@@ -0,0 +1,182 @@
+package master
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// Prefixes of the raft log entries and of the raft state in the BadgerDB of
+// the raft log
+const (
+	raftLogPrefix    = "log_"
+	raftStablePrefix = "stable_"
+)
+
+// Raft checks for this exact message when a key of the stable store was
+// never set
+var errRaftKeyNotFound = errors.New("not found")
+
+// Raft log and state of a master server, kept in their own BadgerDB
+// Writes are synced to disk, since a master server must not forget a vote
+// or an entry it acknowledged
+type raftLogStore struct {
+	db *badger.DB
+}
+
+// Open the raft log in the given directory
+func openRaftLogStore(dir string) (*raftLogStore, error) {
+	options := badger.DefaultOptions(dir)
+	options.Logger = nil
+	options.SyncWrites = true
+	db, err := badger.Open(options)
+	if err != nil {
+		return nil, err
+	}
+	return &raftLogStore{db}, nil
+}
+
+// Close the raft log
+func (s *raftLogStore) Close() error {
+	return s.db.Close()
+}
+
+// Key of a raft log entry
+// Indices are big endian, so entries are iterated in order
+func raftLogKey(index uint64) []byte {
+	key := make([]byte, len(raftLogPrefix)+8)
+	copy(key, raftLogPrefix)
+	binary.BigEndian.PutUint64(key[len(raftLogPrefix):], index)
+	return key
+}
+
+// Return the index of the first or last raft log entry, or zero if there
+// are none
+func (s *raftLogStore) edgeIndex(last bool) (uint64, error) {
+	var index uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(raftLogPrefix)
+		opts.PrefetchValues = false
+		opts.Reverse = last
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		if last {
+			it.Seek(raftLogKey(^uint64(0)))
+		} else {
+			it.Rewind()
+		}
+		if it.Valid() {
+			index = binary.BigEndian.Uint64(it.Item().Key()[len(raftLogPrefix):])
+		}
+		return nil
+	})
+	return index, err
+}
+
+// Return the index of the first raft log entry
+func (s *raftLogStore) FirstIndex() (uint64, error) {
+	return s.edgeIndex(false)
+}
+
+// Return the index of the last raft log entry
+func (s *raftLogStore) LastIndex() (uint64, error) {
+	return s.edgeIndex(true)
+}
+
+// Retrieve a raft log entry
+func (s *raftLogStore) GetLog(index uint64, l *raft.Log) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(raftLogKey(index))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return raft.ErrLogNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, l)
+		})
+	})
+}
+
+// Store a raft log entry
+func (s *raftLogStore) StoreLog(l *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{l})
+}
+
+// Store raft log entries
+func (s *raftLogStore) StoreLogs(logs []*raft.Log) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, l := range logs {
+		value, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		err = wb.Set(raftLogKey(l.Index), value)
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// Delete the raft log entries in a range, inclusive
+func (s *raftLogStore) DeleteRange(min uint64, max uint64) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for index := min; index <= max && index >= min; index++ {
+		err := wb.Delete(raftLogKey(index))
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// Set a key of the raft state
+func (s *raftLogStore) Set(key []byte, val []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte(raftStablePrefix), key...), val)
+	})
+}
+
+// Retrieve a key of the raft state
+func (s *raftLogStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte(raftStablePrefix), key...))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return errRaftKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	return value, err
+}
+
+// Set a number of the raft state
+func (s *raftLogStore) SetUint64(key []byte, val uint64) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, val)
+	return s.Set(key, value)
+}
+
+// Retrieve a number of the raft state
+func (s *raftLogStore) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
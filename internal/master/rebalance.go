@@ -0,0 +1,477 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/orellazri/tdkvs/internal/placement"
+)
+
+// Amount of keys read from BadgerDB at a time while rebalancing
+const rebalanceBatchSize = 100
+
+// Persisted state of a rebalance, so a restarted master server can
+// continue where it left off
+type rebalanceJob struct {
+	NumVolumes int               `json:"num_volumes"`      // Amount of buckets being rebalanced to
+	Replicas   int               `json:"replicas"`         // Amount of replicas being rebalanced to
+	Placement  string            `json:"placement"`        // Placement strategy being rebalanced to
+	Labels     map[string]labels `json:"labels,omitempty"` // Labels of the volume servers being rebalanced to
+	LastKey    string            `json:"last_key"`         // Last key that was processed
+	Scanned    int               `json:"scanned"`          // Amount of keys processed so far
+	Moved      int               `json:"moved"`            // Amount of keys moved so far
+	Failed     int               `json:"failed"`           // Amount of keys that could not be moved
+
+	Retiring  *retirement  `json:"retiring,omitempty"`  // Volume server being retired, if the rebalance decommissions one
+	Replacing *replacement `json:"replacing,omitempty"` // Failed volume server being replaced, if the rebalance rebuilds one
+}
+
+// Check if a job rebalances to the given buckets
+// Jobs persisted before placement strategies were selectable used jump
+// consistent hash
+func (job *rebalanceJob) matches(numVolumes int, replicas int, strategy string, l map[string]labels, retiring *retirement, replacing *replacement) bool {
+	jobStrategy := job.Placement
+	if jobStrategy == "" {
+		jobStrategy = placement.Jump
+	}
+	return job.NumVolumes == numVolumes && job.Replicas == replicas && jobStrategy == strategy && sameLabels(job.Labels, l) && job.Retiring.matches(retiring) && job.Replacing.matches(replacing)
+}
+
+// A key and its metakey
+type keyEntry struct {
+	key string
+	m   *metakey
+}
+
+// Retrieve the rebalance job, or nil if no rebalance is in progress
+func getRebalanceJob(db *store) (*rebalanceJob, error) {
+	var job *rebalanceJob
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("_meta_rebalance"))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			job = &rebalanceJob{}
+			return json.Unmarshal(v, job)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	return job, err
+}
+
+// Persist the rebalance job
+func setRebalanceJob(db *store, job *rebalanceJob) error {
+	return db.Update(func(txn kvTxn) error {
+		return putRebalanceJob(txn, job)
+	})
+}
+
+// Persist the rebalance job in a transaction
+func putRebalanceJob(txn kvTxn, job *rebalanceJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte("_meta_rebalance"), value)
+}
+
+// Read the next batch of keys that come after a given key
+func nextKeys(db *store, after string, limit int) ([]keyEntry, error) {
+	entries := []keyEntry{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = limit
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek([]byte(after)); it.Valid() && len(entries) < limit; it.Next() {
+			item := it.Item()
+			key := string(item.Key())
+
+			// Skip meta keys and the key we already processed
+			if strings.HasPrefix(key, "_meta") || key == after {
+				continue
+			}
+
+			err := item.Value(func(v []byte) error {
+				m, err := decodeMetakey(v)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, keyEntry{key, m})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Count the keys that come after a given key
+func countKeysAfter(db *store, after string) (int, error) {
+	count := 0
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek([]byte(after)); it.Valid(); it.Next() {
+			key := string(it.Item().Key())
+			if strings.HasPrefix(key, "_meta") || key == after {
+				continue
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Rebalance keys in volume servers
+// Progress is persisted after every batch of keys, so an interrupted
+// rebalance continues from the last processed key on the next start.
+// If a bucket is being retired, it is remapped first, and the last bucket
+// is removed once all of its keys were moved. Buckets are retired one at a
+// time until every volume server has as many buckets as its weight
+func rebalanceVolumes(c *context) error {
+	for {
+		ctl := newRebalanceControl()
+
+		c.mu.Lock()
+		c.control = ctl
+		retiring := c.retiring
+		c.mu.Unlock()
+
+		err := rebalance(c, ctl)
+		if errors.Is(err, errRebalanceCancelled) {
+			// Keys that were moved stay where they are, and the rest are not moved.
+			// A cancelled decommission keeps the buckets of the volume server, except
+			// for the ones that were already remapped to another volume server
+			err = c.db.Update(func(txn kvTxn) error {
+				return txn.Delete([]byte("_meta_rebalance"))
+			})
+			if err == nil {
+				err = errRebalanceCancelled
+			}
+
+			if retiring != nil {
+				c.abandonRetirement(retiring)
+			}
+			c.setRetiring(nil)
+
+			// A cancelled replacement keeps the new volume server, with the keys
+			// that were already copied to it
+			c.mu.Lock()
+			c.replacing = nil
+			c.mu.Unlock()
+		}
+
+		ctl.finish(err)
+		if err != nil {
+			return err
+		}
+
+		// Continue with the next bucket to retire, if any
+		c.mu.RLock()
+		next := c.retiring
+		c.mu.RUnlock()
+		if next == nil {
+			return nil
+		}
+	}
+}
+
+// Run the steps of a rebalance
+func rebalance(c *context, ctl *rebalanceControl) error {
+	c.mu.RLock()
+	numVolumes := len(c.buckets)
+	retiring := c.retiring
+	replacing := c.replacing
+	l := c.labels
+	c.mu.RUnlock()
+
+	job, err := getRebalanceJob(c.db)
+	if err != nil {
+		return err
+	}
+
+	if job != nil && job.matches(numVolumes, c.config.Replicas, c.config.Placement, l, retiring, replacing) {
+		if job.Scanned > 0 {
+			log.Printf("Resuming rebalance after key \"%v\" (%v keys scanned, %v moved)", job.LastKey, job.Scanned, job.Moved)
+		}
+
+		// The persisted job knows whether the bucket was already remapped
+		if job.Retiring != nil && job.Retiring.Remapped != retiring.Remapped {
+			c.setRetiring(job.Retiring)
+		}
+	} else {
+		if job != nil {
+			log.Println("Volume servers changed since the last rebalance was interrupted. Starting over")
+		}
+		job = &rebalanceJob{
+			NumVolumes: numVolumes,
+			Replicas:   c.config.Replicas,
+			Placement:  c.config.Placement,
+			Labels:     l,
+			Retiring:   retiring,
+			Replacing:  replacing,
+		}
+		err := setRebalanceJob(c.db, job)
+		if err != nil {
+			return err
+		}
+	}
+
+	if job.Retiring.remapping() {
+		err := remapBucket(c, ctl, job)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A replaced volume server keeps its buckets, so keys are only copied to
+	// the new volume server
+	if job.Replacing != nil {
+		err := scanKeys(c, ctl, job, func(c *context, key string) (bool, error) {
+			return rebuildKey(c, key, job.Replacing)
+		})
+		if err != nil {
+			return err
+		}
+		return finishRebalance(c, job)
+	}
+
+	// A spare volume server took over the retired bucket, so no key has to move
+	if job.Retiring == nil || job.Retiring.Drain {
+		err := scanKeys(c, ctl, job, rebalanceKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return finishRebalance(c, job)
+}
+
+// Remove the drained bucket, set metakeys to the new number of buckets and
+// replicas, and finish the job in the same transaction
+// If another bucket has to be retired, its job is persisted in the same
+// transaction as well, so the weights it retires to are never lost
+func finishRebalance(c *context, job *rebalanceJob) error {
+	// Requests are paused while the drained bucket is removed, so none of them
+	// uses it after it is gone
+	c.membership.Lock()
+	defer c.membership.Unlock()
+
+	buckets := c.volumes()
+	if job.Retiring != nil && job.Retiring.Drain {
+		buckets = append([]string{}, buckets[:len(buckets)-1]...)
+	}
+
+	c.mu.RLock()
+	next := nextRetirement(buckets, c.weights, c.spares)
+	c.mu.RUnlock()
+
+	err := c.db.Update(func(txn kvTxn) error {
+		err := putBuckets(txn, buckets)
+		if err != nil {
+			return err
+		}
+		err = putMetaNumber(txn, "_meta_num_volumes", len(buckets))
+		if err != nil {
+			return err
+		}
+		err = putMetaNumber(txn, "_meta_replicas", c.config.Replicas)
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte("_meta_placement"), []byte(c.config.Placement))
+		if err != nil {
+			return err
+		}
+		err = putLabels(txn, job.Labels)
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			return putRebalanceJob(txn, &rebalanceJob{NumVolumes: len(buckets), Replicas: c.config.Replicas, Placement: c.config.Placement, Labels: job.Labels, Retiring: next})
+		}
+		return txn.Delete([]byte("_meta_rebalance"))
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.buckets = buckets
+	c.retiring = next
+	c.replacing = nil
+	c.mu.Unlock()
+
+	if job.Replacing != nil {
+		unrecoverable, err := listUnrecoverable(c.db)
+		if err != nil {
+			return err
+		}
+		log.Printf("Volume server %v was replaced by %v. %v keys are unrecoverable (see /admin/unrecoverable)", job.Replacing.Volume, job.Replacing.To, len(unrecoverable))
+	}
+	if job.Retiring != nil {
+		log.Printf("Bucket %v of volume server %v retired", job.Retiring.Bucket, job.Retiring.Volume)
+		if job.Retiring.Weight == 0 && countVolume(buckets, job.Retiring.Volume) == 0 {
+			log.Printf("Volume server %v has no buckets left. Remove it from the master's config yaml file and shut it down", job.Retiring.Volume)
+		}
+	}
+	log.Println("Rebalancing done!")
+	return nil
+}
+
+// Run a function on every key in batches, i.e. to move every key that is
+// not in the buckets chosen for it
+func scanKeys(c *context, ctl *rebalanceControl, job *rebalanceJob, moveKey func(c *context, key string) (bool, error)) error {
+	remaining, err := countKeysAfter(c.db, job.LastKey)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebalancing volumes... %v keys remaining", remaining)
+	ctl.update(job, remaining)
+
+	for {
+		if ctl.cancelled() {
+			return errRebalanceCancelled
+		}
+
+		entries, err := nextKeys(c.db, job.LastKey, rebalanceBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		// The whole batch is processed before the progress is persisted, so
+		// keys are never skipped if the master server stops in the middle
+		moved, failed := rebalanceBatch(c, ctl, entries, moveKey)
+		if ctl.cancelled() {
+			return errRebalanceCancelled
+		}
+		job.Moved += moved
+		job.Failed += failed
+		job.Scanned += len(entries)
+		job.LastKey = entries[len(entries)-1].key
+
+		err = setRebalanceJob(c.db, job)
+		if err != nil {
+			return err
+		}
+
+		remaining -= len(entries)
+		if remaining < 0 {
+			remaining = 0
+		}
+		ctl.update(job, remaining)
+		log.Printf("Rebalanced %v keys (%v moved, %v failed), %v keys remaining", job.Scanned, job.Moved, job.Failed, remaining)
+	}
+
+	if job.Failed > 0 {
+		// Start the next rebalance from the beginning, skipping keys that are
+		// already in place
+		failed := job.Failed
+		job = &rebalanceJob{NumVolumes: job.NumVolumes, Replicas: job.Replicas, Placement: job.Placement, Labels: job.Labels, Retiring: job.Retiring, Replacing: job.Replacing}
+		err := setRebalanceJob(c.db, job)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%v keys could not be moved. Restart the master server or retry the operation", failed)
+	}
+
+	return nil
+}
+
+// Move a batch of keys using a pool of workers
+// Returns the amount of keys that were moved and that failed
+func rebalanceBatch(c *context, ctl *rebalanceControl, entries []keyEntry, moveKey func(c *context, key string) (bool, error)) (int, int) {
+	workers := c.config.RebalanceWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var mu sync.Mutex
+	moved, failed := 0, 0
+
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				// Skip the rest of the keys if the rebalance was cancelled
+				if !ctl.proceed() {
+					continue
+				}
+
+				ok, err := moveKey(c, key)
+
+				mu.Lock()
+				if err != nil {
+					log.Printf("Could not move key \"%v\": %v", key, err)
+					failed++
+				} else if ok {
+					moved++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, entry := range entries {
+		keys <- entry.key
+	}
+	close(keys)
+	wg.Wait()
+
+	return moved, failed
+}
+
+// Move a key to the volume servers chosen for it if needed
+// Returns whether the key was moved
+func rebalanceKey(c *context, key string) (bool, error) {
+	c.membership.RLock()
+	defer c.membership.RUnlock()
+
+	unlock := c.locks.lock(key)
+	defer unlock()
+
+	// Read the metakey again since the key may have been set or deleted
+	// after it was read in a batch
+	m, err := lookupMetakey(c, key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	hash, newVolumes := c.chooseVolumes(key)
+	if sameVolumes(m.Volumes, newVolumes) {
+		return false, nil
+	}
+
+	log.Printf("Moving key \"%v\" to volume servers %v", key, newVolumes)
+
+	err = migrateKey(c, key, hash, m.Volumes, newVolumes)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,182 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/orellazri/tdkvs/internal/utils"
+)
+
+// Key of the persisted state of a rehash in BadgerDB
+const rehashJobKey = "_meta_rehash"
+
+// Persisted state of a rehash, so a restarted rehash continues where it
+// left off
+type rehashJob struct {
+	From    string `json:"from"`     // Hash function keys are rehashed from
+	To      string `json:"to"`       // Hash function keys are rehashed to
+	LastKey string `json:"last_key"` // Last key that was processed or journaled
+	Scanned int    `json:"scanned"`  // Amount of keys processed so far
+}
+
+// Retrieve the rehash job, or nil if no rehash is in progress
+func getRehashJob(db *store) (*rehashJob, error) {
+	var job *rehashJob
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(rehashJobKey))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			job = &rehashJob{}
+			return json.Unmarshal(v, job)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	return job, err
+}
+
+// Persist the rehash job in a transaction
+func putRehashJob(txn kvTxn, job *rehashJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(rehashJobKey), value)
+}
+
+// Retrieve the hash function keys are stored with
+// Keys stored before the hash function was selectable were hashed with FNV,
+// and a new store uses the given hash function
+func getMetaHash(db *store, hashID string) (string, error) {
+	metaHash, err := getMetaString(db, "_meta_hash")
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return metaHash, err
+	}
+
+	_, err = getMetaNumber(db, "_meta_num_volumes")
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return hashID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return utils.HashFNV, nil
+}
+
+// Check that keys are stored with the hash function in the config
+func checkHash(db *store, metaHash string, hashID string) error {
+	job, err := getRehashJob(db)
+	if err != nil {
+		return err
+	}
+	if job != nil {
+		return fmt.Errorf("a rehash to the %v hash function was interrupted. Run the master server with -rehash to finish it", job.To)
+	}
+
+	if metaHash != hashID {
+		return fmt.Errorf("keys are hashed with the %v hash function but the config uses %v. Run the master server with -rehash to move them", metaHash, hashID)
+	}
+	return nil
+}
+
+// Rehash every key with the hash function in the config, and move its value
+// to its new path and volume servers
+// Keys are moved one at a time with the migration journal, while the master
+// server does not serve requests. The job is updated in the same transaction
+// as the journal entry of every key, so no key is ever moved twice
+func rehashKeys(c *context, metaHash string, hashID string) error {
+	job, err := getRehashJob(c.db)
+	if err != nil {
+		return err
+	}
+
+	if job == nil {
+		if metaHash == hashID {
+			log.Printf("Keys are already hashed with the %v hash function", hashID)
+			return nil
+		}
+
+		// Keys are placed with the new hash function, so the volume servers must
+		// be settled first
+		if c.rebalancing {
+			return errors.New("a rebalance is pending. Start the master server with the current hash function to finish it first")
+		}
+		job = &rehashJob{From: metaHash, To: hashID}
+	} else if job.To != hashID {
+		return fmt.Errorf("a rehash to the %v hash function was interrupted. Finish it with that hash function first", job.To)
+	} else {
+		log.Printf("Resuming rehash after key \"%v\" (%v keys scanned)", job.LastKey, job.Scanned)
+	}
+
+	from, err := utils.NewHasher(job.From)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rehashing keys from the %v hash function to %v...", job.From, job.To)
+	for {
+		entries, err := nextKeys(c.db, job.LastKey, rebalanceBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			err := rehashKey(c, job, from, entry)
+			if err != nil {
+				return fmt.Errorf("could not rehash key \"%v\": %w", entry.key, err)
+			}
+		}
+		log.Printf("Rehashed %v keys", job.Scanned)
+	}
+
+	err = c.db.Update(func(txn kvTxn) error {
+		err := txn.Set([]byte("_meta_hash"), []byte(job.To))
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(rehashJobKey))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("Rehashing done!")
+	return nil
+}
+
+// Move a key to its path and volume servers under the new hash function
+func rehashKey(c *context, job *rehashJob, from utils.Hasher, entry keyEntry) error {
+	hash, to := c.chooseVolumes(entry.key)
+	mig := &migration{
+		Key:     entry.key,
+		Hash:    from(entry.key),
+		NewHash: &hash,
+		From:    entry.m.Volumes,
+		To:      to,
+	}
+
+	job.LastKey = entry.key
+	job.Scanned++
+	err := c.db.Update(func(txn kvTxn) error {
+		err := setMigration(txn, mig)
+		if err != nil {
+			return err
+		}
+		return putRehashJob(txn, job)
+	})
+	if err != nil {
+		return err
+	}
+
+	return runMigration(c, mig)
+}
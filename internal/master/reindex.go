@@ -0,0 +1,172 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Amount of keys listed by a volume server whose metakeys are written in
+// the same transaction while rebuilding the index
+const rebuildBatchSize = 1000
+
+// Check that the index can be rebuilt in the BadgerDB
+// An index that was rebuilt, or never lost, has the amount of volume
+// servers set, which a rebuild that was interrupted has not
+func checkRebuildable(db *store) error {
+	_, err := getMetaNumber(db, "_meta_num_volumes")
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("the BadgerDB in %v already holds an index. Rebuild into an empty directory", db.Opts().Dir)
+}
+
+// Adopt the cluster id of the volume servers, so a master server that lost
+// its BadgerDB can claim them again
+// Volume servers that belong to different clusters are an error
+func adoptClusterID(db *store, urls []string) error {
+	_, err := getMetaString(db, clusterIDKey)
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+
+	clusterID := ""
+	for _, url := range urls {
+		id, err := identityOfVolume(url)
+		if err != nil {
+			return fmt.Errorf("could not retrieve the identity of volume server %v: %w", url, err)
+		}
+		if id.ClusterID == "" {
+			continue
+		}
+		if clusterID != "" && id.ClusterID != clusterID {
+			return fmt.Errorf("volume servers belong to different clusters: %v and %v", clusterID, id.ClusterID)
+		}
+		clusterID = id.ClusterID
+	}
+	if clusterID == "" {
+		return nil
+	}
+
+	log.Printf("Adopting cluster id %v of the volume servers", clusterID)
+	return setMetaString(db, clusterIDKey, clusterID)
+}
+
+// Rebuild the metakeys from the keys stored in the volume servers, i.e.
+// after the BadgerDB of the master server was lost
+// Every volume server must be up, since a key whose replicas are not listed
+// would lose them. A replica is recorded in the bucket placement chooses
+// for the key when its volume server holds one, so keys that are where they
+// belong need no rebalance
+// Returns the amount of keys that were found
+func rebuildIndex(c *context) (int, error) {
+	urls := []string{}
+	for _, url := range c.volumes() {
+		if !containsVolume(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+
+	found := 0
+	for _, url := range urls {
+		log.Printf("Scanning volume server %v...", url)
+
+		batch := []*volumeKey{}
+		err := listVolumeKeys(url, func(k *volumeKey) error {
+			batch = append(batch, k)
+			if len(batch) < rebuildBatchSize {
+				return nil
+			}
+
+			n, err := indexKeys(c, url, batch)
+			found += n
+			batch = []*volumeKey{}
+			return err
+		})
+		if err == nil {
+			var n int
+			n, err = indexKeys(c, url, batch)
+			found += n
+		}
+		if err != nil {
+			return found, fmt.Errorf("could not rebuild the index from volume server %v: %w", url, err)
+		}
+	}
+	return found, nil
+}
+
+// Record the replicas of keys listed by a volume server in their metakeys
+// Returns the amount of keys that had no metakey yet
+func indexKeys(c *context, url string, keys []*volumeKey) (int, error) {
+	table := c.volumes()
+
+	found := 0
+	err := c.db.Update(func(txn kvTxn) error {
+		for _, k := range keys {
+			if strings.HasPrefix(k.Key, "_meta") {
+				log.Printf("Skipping key \"%v\" in volume server %v since it is reserved for metadata", k.Key, url)
+				continue
+			}
+
+			hash, chosen := c.chooseVolumes(k.Key)
+			if fmt.Sprintf("%v", hash) != k.Hash {
+				if k.Partial {
+					log.Printf("Value %v_%v in volume server %v was stored without its key and cannot be recovered", k.Hash, k.Key, url)
+				} else {
+					log.Printf("Key \"%v\" in volume server %v is stored under another hash function. Skipping it", k.Key, url)
+				}
+				continue
+			}
+
+			bucket := -1
+			for _, b := range chosen {
+				if table[b] == url {
+					bucket = int(b)
+				}
+			}
+			for i := 0; bucket == -1 && i < len(table); i++ {
+				if table[i] == url {
+					bucket = i
+				}
+			}
+
+			m, err := getMetakey(txn, k.Key)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				m = &metakey{}
+				found++
+			} else if err != nil {
+				return err
+			}
+			if m.hasVolume(uint32(bucket)) {
+				continue
+			}
+
+			// Replicas in the buckets placement chooses come first, in its order
+			rank := func(b uint32) int {
+				for i, chosenBucket := range chosen {
+					if chosenBucket == b {
+						return i
+					}
+				}
+				return len(chosen)
+			}
+			m.Volumes = append(m.Volumes, uint32(bucket))
+			sort.SliceStable(m.Volumes, func(i, j int) bool { return rank(m.Volumes[i]) < rank(m.Volumes[j]) })
+			m.Size = k.Size
+
+			err = setMetakey(txn, k.Key, m)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,264 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+)
+
+// Prefix of the markers of keys that could not be rebuilt
+const unrecoverablePrefix = "_meta_unrecoverable_"
+
+// Replacement of a failed volume server by a fresh one
+// The buckets of the failed volume server point to the new one right away,
+// and the keys it held are copied to it from their other replicas. Keys
+// without other replicas are marked as unrecoverable
+type replacement struct {
+	Volume string `json:"volume"` // Url of the failed volume server
+	To     string `json:"to"`     // Url of the volume server that replaces it
+}
+
+// Check if two replacements replace the same volume server
+func (r *replacement) matches(other *replacement) bool {
+	if r == nil || other == nil {
+		return r == nil && other == nil
+	}
+	return *r == *other
+}
+
+// Key that could not be rebuilt as reported by the admin API
+type unrecoverableKey struct {
+	Key    string `json:"key"`
+	Volume string `json:"volume"` // Url of the failed volume server that held its only replica
+}
+
+// Point the buckets of a failed volume server to the volume server that
+// replaces it, and persist the rebuild in the same transaction
+// Requests are paused while the buckets are switched, so none of them uses
+// the failed volume server afterwards
+func (c *context) replaceVolume(r *replacement) error {
+	c.membership.Lock()
+	defer c.membership.Unlock()
+
+	buckets := append([]string{}, c.volumes()...)
+	for i, url := range buckets {
+		if url == r.Volume {
+			buckets[i] = r.To
+		}
+	}
+
+	job := &rebalanceJob{
+		NumVolumes: len(buckets),
+		Replicas:   c.config.Replicas,
+		Placement:  c.config.Placement,
+		Replacing:  r,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The new volume server takes the weight and labels of the failed one, so
+	// keys are placed in the same buckets
+	l := make(map[string]labels)
+	for url, other := range c.labels {
+		if url == r.Volume {
+			url = r.To
+		}
+		l[url] = other
+	}
+	job.Labels = l
+
+	err := c.db.Update(func(txn kvTxn) error {
+		err := putBuckets(txn, buckets)
+		if err != nil {
+			return err
+		}
+		return putRebalanceJob(txn, job)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.buckets = buckets
+	c.labels = l
+	c.weights[r.To] = c.weights[r.Volume]
+	delete(c.weights, r.Volume)
+	delete(c.spares, r.Volume)
+	c.replacing = r
+	return nil
+}
+
+// Handle replacing a failed volume server at runtime
+// The request body is the url of the fresh volume server that replaces it
+func replaceVolumeHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil {
+		http.Error(w, "Invalid volume server index", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "An error occurred while parsing request body", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	url := strings.TrimSuffix(strings.TrimSpace(string(data)), "/")
+	if url == "" {
+		http.Error(w, "Volume server url is required", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.RLock()
+	exists := containsVolume(c.buckets, url)
+	c.mu.RUnlock()
+	if exists {
+		http.Error(w, fmt.Sprintf("Volume server %v already exists", url), http.StatusBadRequest)
+		return
+	}
+
+	// Make sure the new volume server is up and is the one we expect before
+	// copying keys to it
+	err = c.verifyVolume(url)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	c.mu.Lock()
+	if c.rebalancing {
+		c.mu.Unlock()
+		http.Error(w, "A rebalance is already running", http.StatusConflict)
+		return
+	}
+	if index < 0 || index >= len(c.buckets) {
+		c.mu.Unlock()
+		http.Error(w, fmt.Sprintf("volume %v is not in the range [0, %v)", index, len(c.buckets)), http.StatusBadRequest)
+		return
+	}
+	c.rebalancing = true
+	replacing := &replacement{Volume: c.buckets[index], To: url}
+	c.mu.Unlock()
+
+	err = c.replaceVolume(replacing)
+	if err != nil {
+		c.mu.Lock()
+		c.rebalancing = false
+		c.mu.Unlock()
+		http.Error(w, fmt.Sprintf("An error occurred while replacing volume server %v", replacing.Volume), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Replacing volume server %v with %v", replacing.Volume, replacing.To)
+	go runRebalance(c)
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "replacing volume server %v with %v. rebuilding", replacing.Volume, replacing.To)
+}
+
+// Copy a key that the failed volume server held to the volume server that
+// replaces it, from one of its other replicas
+// Returns whether the key was copied
+func rebuildKey(c *context, key string, r *replacement) (bool, error) {
+	c.membership.RLock()
+	defer c.membership.RUnlock()
+
+	unlock := c.locks.lock(key)
+	defer unlock()
+
+	m, err := lookupMetakey(c, key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	hints, err := lookupHints(c.db, key)
+	if err != nil {
+		return false, err
+	}
+
+	// Replicas that were handed off are copied from their fallback volume
+	// servers, including the one of the failed volume server
+	urls := c.volumes()
+	affected := false
+	sources := []string{}
+	for _, numVolume := range m.Volumes {
+		source := urls[numVolume]
+		if source == r.To {
+			affected = true
+		}
+		if h := hintFor(hints, numVolume); h != nil {
+			source = h.Fallback
+		}
+		if source != r.To && !containsVolume(sources, source) {
+			sources = append(sources, source)
+		}
+	}
+	if !affected {
+		return false, nil
+	}
+
+	if len(sources) == 0 {
+		log.Printf("Key \"%v\" is unrecoverable. Its only replica was in volume server %v", key, r.Volume)
+		err := c.db.Update(func(txn kvTxn) error {
+			return txn.Set([]byte(unrecoverablePrefix+key), []byte(r.Volume))
+		})
+		return false, err
+	}
+
+	hash := c.hash(key)
+	_, err = copyValue(c, key, hash, sources, r.To, hash)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// List the keys that could not be rebuilt
+func listUnrecoverable(db *store) ([]unrecoverableKey, error) {
+	keys := []unrecoverableKey{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(unrecoverablePrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := strings.TrimPrefix(string(it.Item().Key()), unrecoverablePrefix)
+			err := it.Item().Value(func(v []byte) error {
+				keys = append(keys, unrecoverableKey{key, string(v)})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Handle listing the keys that could not be rebuilt
+// A key is no longer listed once it is set again or deleted
+func unrecoverableHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	keys, err := listUnrecoverable(c.db)
+	if err != nil {
+		http.Error(w, "An error occurred while listing unrecoverable keys", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
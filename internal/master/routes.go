@@ -1,7 +1,6 @@
 package master
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -11,7 +10,6 @@ import (
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
-	"github.com/orellazri/tdkvs/internal/utils"
 )
 
 // Handle index route
@@ -29,43 +27,10 @@ func getKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 		return
 	}
 
-	err := c.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
-		if err != nil {
-			return err
-		}
-
-		// Key exists. Retrieve from volume server
-		err = item.Value(func(v []byte) error {
-			numVolume := binary.BigEndian.Uint32(v)
-			hash := utils.HashString(key)
-
-			// Send request to volume server
-			resp, err := http.Get(fmt.Sprintf("%v/get/%v?hash=%v&as=%v", c.config.Volumes[numVolume], key, hash, as))
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != 200 {
-				return errors.New("respose from volume server is not 200 OK")
-			}
-
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return err
-			}
-
-			log.Printf("Got key \"%v\" from volume server %v", key, numVolume)
-			w.Write(body)
-			return nil
-		})
-		if err != nil {
-			return err
-		}
+	c.membership.RLock()
+	defer c.membership.RUnlock()
 
-		return nil
-	})
+	m, err := lookupMetakey(c, key)
 
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
@@ -75,7 +40,44 @@ func getKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 			http.Error(w, fmt.Sprintf("An error occurred while retrieving key \"%v\"", key), http.StatusInternalServerError)
 			log.Println(err)
 		}
+		return
+	}
+
+	consistency, err := requestConsistency(r, c.config.ReadConsistency)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Key exists. Retrieve it from its replicas
+	hash := c.hash(key)
+	result, err := readReplicas(c, key, hash, as, m.Volumes, consistency)
+	if err != nil {
+		// The key may have been moved to other volume servers while it was
+		// being read. Retry with its current metakey
+		current, lookupErr := lookupMetakey(c, key)
+		if lookupErr == nil && !sameVolumes(current.Volumes, m.Volumes) {
+			m = current
+			result, err = readReplicas(c, key, hash, as, m.Volumes, consistency)
+		}
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("An error occurred while retrieving key \"%v\": %v", key, err), http.StatusInternalServerError)
+		return
 	}
+
+	setReplicasHeader(w, len(result.succeeded), len(m.Volumes))
+	if len(result.failed) > 0 {
+		w.Header().Set("X-Tdkvs-Failed-Replicas", fmt.Sprintf("%v", result.failed))
+	}
+	if result.conflict {
+		log.Printf("Replicas of key \"%v\" do not agree on its value", key)
+		w.Header().Set("X-Tdkvs-Conflict", "true")
+	}
+
+	log.Printf("Got key \"%v\" from volume servers %v", key, result.succeeded)
+	w.Write(result.value)
 }
 
 // Handle setting keys
@@ -87,6 +89,16 @@ func setKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 		return
 	}
 
+	// Keys starting with _meta hold the metadata of the master server, and
+	// are never listed as referenced by garbage collection
+	if strings.HasPrefix(key, "_meta") {
+		http.Error(w, "Keys starting with _meta are reserved", http.StatusBadRequest)
+		return
+	}
+
+	c.membership.RLock()
+	defer c.membership.RUnlock()
+
 	// Read request body
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -94,42 +106,90 @@ func setKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 		log.Println(err)
 		return
 	}
-	value := string(data)
-	if value == "" {
+	if len(data) == 0 {
 		http.Error(w, "Request body is required", http.StatusBadRequest)
 		return
 	}
 
-	// Choose bucket and generate ahsh
-	hash, numVolume := utils.ChooseBucketString(key, int32(len(c.config.Volumes)))
-
-	// Send request to volume server
-	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%v/set/%v?hash=%v", c.config.Volumes[numVolume], key, hash), strings.NewReader(value))
+	consistency, err := requestConsistency(r, c.config.WriteConsistency)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("An error occurred while setting key \"%v\"", key), http.StatusInternalServerError)
-		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	client := http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("An error occurred while setting key \"%v\"", key), http.StatusInternalServerError)
-		log.Println(err)
-		return
+
+	unlock := c.locks.lock(key)
+	defer unlock()
+
+	// Choose buckets and generate hash
+	hash, numVolumes := c.chooseVolumes(key)
+	required := requiredReplicas(consistency, len(numVolumes))
+
+	// Send request to every replica's volume server
+	_, failed := fanOut(numVolumes, func(numVolume uint32) error {
+		for _, url := range c.writeVolumes([]uint32{numVolume}) {
+			err := setInVolume(url, key, hash, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for numVolume, err := range failed {
+		log.Printf("Could not set key \"%v\" in volume server %v: %v", key, numVolume, err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		http.Error(w, fmt.Sprintf("An error occurred while setting key \"%v\"", key), http.StatusInternalServerError)
+	// Replicas that could not be written are handed off to other volume
+	// servers, and count as written
+	hints := []hint{}
+	if c.config.HintedHandoff && len(failed) > 0 {
+		hints = handOff(c, key, hash, data, numVolumes, failedVolumes(failed))
+		for _, h := range hints {
+			delete(failed, h.Bucket)
+		}
+	}
+	written := []uint32{}
+	for _, numVolume := range numVolumes {
+		if _, ok := failed[numVolume]; !ok {
+			written = append(written, numVolume)
+		}
+	}
+
+	setReplicasHeader(w, len(written), len(numVolumes))
+	if len(written) < required {
+		deleteHandedOff(key, hints, nil)
+		http.Error(w, fmt.Sprintf("Key \"%v\" could only be written to %v of %v replicas (%v required)", key, len(written), len(numVolumes), required), http.StatusInternalServerError)
 		return
 	}
 
-	// Key is set, add metakey to db
-	err = c.db.Update(func(txn *badger.Txn) error {
-		var numVolumeBytes [4]byte
-		binary.BigEndian.PutUint32(numVolumeBytes[0:4], uint32(numVolume))
-		err := txn.Set([]byte(key), numVolumeBytes[:])
-		return err
+	// Key is set, add metakey to db with the replicas that were written.
+	// Keep track of replicas that are no longer up to date if the key
+	// was previously stored elsewhere
+	m := &metakey{Volumes: written, Size: int64(len(data))}
+	var previous *metakey
+	var previousHints []hint
+	err = c.db.Update(func(txn kvTxn) error {
+		var err error
+		previous, err = getMetakey(txn, key)
+		if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		// Writes that were handed off before are superseded by this one
+		previousHints, err = getHints(txn, key)
+		if err != nil {
+			return err
+		}
+		err = putHints(txn, key, hints)
+		if err != nil {
+			return err
+		}
+
+		// A key that was lost with a failed volume server is stored again
+		err = txn.Delete([]byte(unrecoverablePrefix + key))
+		if err != nil {
+			return err
+		}
+		return setMetakey(txn, key, m)
 	})
 
 	if err != nil {
@@ -138,7 +198,41 @@ func setKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 		return
 	}
 
-	log.Printf("Set key \"%v\" in volume server %v", key, numVolume)
+	fallbacks := []string{}
+	for _, h := range hints {
+		fallbacks = append(fallbacks, h.Fallback)
+	}
+	deleteHandedOff(key, previousHints, append(c.writeVolumes(m.Volumes), fallbacks...))
+
+	if previous != nil {
+		for _, url := range c.staleVolumes(previous.Volumes, m.Volumes) {
+			if containsVolume(fallbacks, url) {
+				continue
+			}
+			err := deleteFromVolume(url, key, hash)
+			if err != nil {
+				log.Printf("Could not delete stale replica of key \"%v\" from volume server %v: %v", key, url, err)
+			}
+		}
+	}
+
+	if len(hints) > 0 {
+		handedOff := []uint32{}
+		for _, h := range hints {
+			handedOff = append(handedOff, h.Bucket)
+		}
+		log.Printf("Handed off replicas %v of key \"%v\" to volume servers %v", handedOff, key, fallbacks)
+		w.Header().Set("X-Tdkvs-Hinted-Replicas", fmt.Sprintf("%v", handedOff))
+	}
+
+	if len(failed) > 0 {
+		log.Printf("Set key \"%v\" in volume servers %v, failed in %v", key, written, failedVolumes(failed))
+		w.Header().Set("X-Tdkvs-Failed-Replicas", fmt.Sprintf("%v", failedVolumes(failed)))
+		fmt.Fprintf(w, "partial: written to %v of %v replicas", len(written), len(numVolumes))
+		return
+	}
+
+	log.Printf("Set key \"%v\" in volume servers %v", key, written)
 	fmt.Fprintf(w, "ok")
 }
 
@@ -150,23 +244,14 @@ func deleteKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 		return
 	}
 
-	var numVolume uint32
+	c.membership.RLock()
+	defer c.membership.RUnlock()
 
-	// Check if key exists in db
-	err := c.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
-		if err != nil {
-			return err
-		}
-
-		item.Value(func(v []byte) error {
-			// Key exists. Get volume number from db
-			numVolume = binary.BigEndian.Uint32(v)
-			return nil
-		})
+	unlock := c.locks.lock(key)
+	defer unlock()
 
-		return nil
-	})
+	// Check if key exists in db
+	m, err := lookupMetakey(c, key)
 
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
@@ -180,34 +265,85 @@ func deleteKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 		}
 	}
 
-	// Key exists
-	hash := utils.HashString(key)
-
-	// Send request to volume server
-	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%v/delete/%v?hash=%v", c.config.Volumes[numVolume], key, hash), strings.NewReader(""))
+	consistency, err := requestConsistency(r, c.config.WriteConsistency)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("An error occurred while deleting key \"%v\"", key), http.StatusInternalServerError)
-		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	client := http.Client{}
-	resp, err := client.Do(req)
+
+	hints, err := lookupHints(c.db, key)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("An error occurred while deleting key \"%v\"", key), http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		http.Error(w, fmt.Sprintf("An error occurred while deleting key \"%v\"", key), http.StatusInternalServerError)
+	// Key exists
+	hash := c.hash(key)
+	required := requiredReplicas(consistency, len(m.Volumes))
+
+	// Send request to every replica's volume server
+	succeeded, failed := fanOut(m.Volumes, func(numVolume uint32) error {
+		// A replica that was handed off is deleted from its fallback volume
+		// server. The volume server of its bucket may still be down
+		if h := hintFor(hints, numVolume); h != nil {
+			for _, url := range c.writeVolumes([]uint32{numVolume}) {
+				err := deleteFromVolume(url, key, hash)
+				if err != nil {
+					log.Printf("Could not delete key \"%v\" from volume server %v, whose replica was handed off: %v", key, url, err)
+				}
+			}
+			return deleteFromVolume(h.Fallback, key, h.Hash)
+		}
+
+		for _, url := range c.writeVolumes([]uint32{numVolume}) {
+			err := deleteFromVolume(url, key, hash)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for numVolume, err := range failed {
+		log.Printf("Could not delete key \"%v\" from volume server %v: %v", key, numVolume, err)
+	}
+
+	setReplicasHeader(w, len(succeeded), len(m.Volumes))
+	if len(succeeded) < required {
+		// Keep the replicas that were not deleted so the delete can be retried
+		err = c.db.Update(func(txn kvTxn) error {
+			kept := &metakey{Volumes: failedVolumes(failed), Size: m.Size}
+			remaining := []hint{}
+			for _, h := range hints {
+				if kept.hasVolume(h.Bucket) {
+					remaining = append(remaining, h)
+				}
+			}
+			err := putHints(txn, key, remaining)
+			if err != nil {
+				return err
+			}
+			return setMetakey(txn, key, kept)
+		})
+		if err != nil {
+			log.Println(err)
+		}
+
+		http.Error(w, fmt.Sprintf("Key \"%v\" could only be deleted from %v of %v replicas (%v required)", key, len(succeeded), len(m.Volumes), required), http.StatusInternalServerError)
 		return
 	}
 
 	// Key is deleted. Delete it from db as well
-	err = c.db.Update(func(txn *badger.Txn) error {
+	err = c.db.Update(func(txn kvTxn) error {
 		err := txn.Delete([]byte(key))
-		return err
+		if err != nil {
+			return err
+		}
+		err = txn.Delete([]byte(hintPrefix + key))
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(unrecoverablePrefix + key))
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("An error occurred while deleting key \"%v\"", key), http.StatusInternalServerError)
@@ -215,6 +351,13 @@ func deleteKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 		return
 	}
 
-	log.Printf("Deleted key \"%v\" from volume server %v", key, numVolume)
+	if len(failed) > 0 {
+		log.Printf("Deleted key \"%v\" from volume servers %v, failed in %v", key, succeeded, failedVolumes(failed))
+		w.Header().Set("X-Tdkvs-Failed-Replicas", fmt.Sprintf("%v", failedVolumes(failed)))
+		fmt.Fprintf(w, "partial: deleted from %v of %v replicas", len(succeeded), len(m.Volumes))
+		return
+	}
+
+	log.Printf("Deleted key \"%v\" from volume servers %v", key, succeeded)
 	fmt.Fprintf(w, "ok")
 }
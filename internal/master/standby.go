@@ -0,0 +1,394 @@
+package master
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/gorilla/mux"
+	"github.com/orellazri/tdkvs/internal/utils"
+)
+
+// Time between full syncs of a standby master server
+// Incremental syncs miss deletes whose tombstones the primary master server
+// compacted away in the meantime, which full syncs catch
+const standbyFullSyncInterval = 5 * time.Minute
+
+// Trailer of the changes stream with the last version in it. A stream
+// without it was cut short
+const changesVersionTrailer = "X-Tdkvs-Version"
+
+// Bit of the meta of a BadgerDB entry that marks it as deleted
+const badgerBitDelete = 1
+
+// Standby config of a master server that serves reads from a copy of the
+// metadata of a primary master server
+type StandbyConfig struct {
+	Primary      string // Url of the primary master server
+	Interval     int    // Optional. Milliseconds between syncs with the primary master server (defaults to 1000)
+	MaxStaleness int    `yaml:"max_staleness"` // Optional. Seconds since the last sync after which reads are redirected to the primary master server (defaults to 10)
+}
+
+// Standby master server
+// It tails the changes to the BadgerDB of the primary master server and
+// serves reads from its own copy, until it is promoted to primary
+type standby struct {
+	config *StandbyConfig
+	c      *context // Serves reads from the copy of the metadata
+	hashID string   // Hash function in the config, used if the primary master server has no keys yet
+
+	mu       sync.RWMutex
+	since    uint64    // Last version of the BadgerDB of the primary master server that was synced
+	lastSync time.Time // Time of the last sync. Zero before the first one
+	lastFull time.Time // Time of the last full sync. Only used by the sync loop
+
+	promote  chan struct{} // Closed when the standby master server is promoted
+	promoted sync.Once
+}
+
+// Create a standby master server over its own BadgerDB
+func newStandby(config *Config, db *store, hashID string) *standby {
+	if config.Standby.Interval == 0 {
+		config.Standby.Interval = 1000
+	}
+	if config.Standby.MaxStaleness == 0 {
+		config.Standby.MaxStaleness = 10
+	}
+
+	return &standby{
+		config: config.Standby,
+		c: &context{
+			config: config,
+			db:     db,
+			health: newHealthTracker(time.Duration(config.SuspectAfter)*time.Second, time.Duration(config.DownAfter)*time.Second),
+		},
+		hashID:  hashID,
+		promote: make(chan struct{}),
+	}
+}
+
+// Return the time since the last sync, and whether it is longer than the
+// given bound. A standby master server that never synced is always stale
+func (s *standby) staleness(bound time.Duration) (time.Duration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.lastSync.IsZero() {
+		return 0, true
+	}
+	lag := time.Since(s.lastSync)
+	return lag, lag > bound
+}
+
+// Sync the copy of the metadata with the primary master server until the
+// standby master server is promoted
+func (s *standby) run() {
+	interval := time.Duration(s.config.Interval) * time.Millisecond
+	for {
+		full := time.Since(s.lastFull) >= standbyFullSyncInterval
+		err := s.sync(full)
+		if err != nil {
+			log.Printf("Could not sync with primary master server %v: %v", s.config.Primary, err)
+		}
+
+		select {
+		case <-s.promote:
+			// Pick up the writes since the last sync, in case the primary
+			// master server is still reachable
+			err := s.sync(false)
+			if err != nil {
+				log.Printf("Could not sync with primary master server %v before promotion: %v", s.config.Primary, err)
+			}
+			log.Println("Standby master server promoted to primary")
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Apply the changes to the metadata of the primary master server since the
+// last sync, or all of its metadata if full
+// A full sync also deletes the keys that the primary master server does
+// not have
+func (s *standby) sync(full bool) error {
+	s.mu.RLock()
+	since := s.since
+	s.mu.RUnlock()
+	if full {
+		since = 0
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%v/admin/changes?since=%v", s.config.Primary, since))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.New("response from primary master server is not 200 OK")
+	}
+
+	wb := s.c.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	// Versions of a key come newest first, so only the first one is applied
+	seen := make(map[string]bool)
+	var last []byte
+	err = readChanges(resp.Body, func(kv *pb.KV) error {
+		if last != nil && bytes.Equal(kv.Key, last) {
+			return nil
+		}
+		last = kv.Key
+
+		if len(kv.Meta) > 0 && kv.Meta[0]&badgerBitDelete != 0 {
+			return wb.Delete(kv.Key)
+		}
+		seen[string(kv.Key)] = true
+		return wb.Set(kv.Key, kv.Value)
+	})
+	if err != nil {
+		return err
+	}
+
+	version, err := strconv.ParseUint(resp.Trailer.Get(changesVersionTrailer), 10, 64)
+	if err != nil {
+		return errors.New("changes from primary master server were cut short")
+	}
+
+	if full {
+		err := s.c.db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				if !seen[string(it.Item().Key())] {
+					err := wb.Delete(it.Item().KeyCopy(nil))
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = wb.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = s.refresh()
+	if err != nil {
+		return err
+	}
+
+	// Backup skips versions up to and including since, despite its docs
+	s.mu.Lock()
+	if version > 0 {
+		s.since = version
+	}
+	s.lastSync = time.Now()
+	s.mu.Unlock()
+
+	if full {
+		s.lastFull = time.Now()
+	}
+	return nil
+}
+
+// Reload the bucket table, and the hash function on the first sync, from
+// the copy of the metadata
+// The hash function only changes with a rehash, which runs while the
+// primary master server is stopped. Restart standby master servers after it
+func (s *standby) refresh() error {
+	if s.c.hash == nil {
+		metaHash, err := getMetaHash(s.c.db, s.hashID)
+		if err != nil {
+			return err
+		}
+		s.c.hash, err = utils.NewHasher(metaHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	buckets, err := getBuckets(s.c.db)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		buckets = []string{}
+		for _, volume := range s.c.config.Volumes {
+			buckets = append(buckets, volume.URL)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	s.c.mu.Lock()
+	s.c.buckets = buckets
+	s.c.mu.Unlock()
+	return nil
+}
+
+// Read a stream of changes to a BadgerDB, as written by its Backup method
+// The stream is a sequence of lists of entries, each prefixed by its size
+func readChanges(r io.Reader, fn func(kv *pb.KV) error) error {
+	reader := bufio.NewReader(r)
+	for {
+		var size uint64
+		err := binary.Read(reader, binary.LittleEndian, &size)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		buf := make([]byte, size)
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			return err
+		}
+
+		list := &pb.KVList{}
+		err = list.Unmarshal(buf)
+		if err != nil {
+			return err
+		}
+		for _, kv := range list.Kv {
+			err := fn(kv)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Handle streaming the changes to the metadata since a version, which
+// standby master servers apply to their copy of it
+func changesHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	since := uint64(0)
+	if param := r.URL.Query().Get("since"); param != "" {
+		var err error
+		since, err = strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			http.Error(w, "Since must be a version number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", changesVersionTrailer)
+	version, err := c.db.Backup(w, since)
+	if err != nil {
+		log.Printf("Could not stream changes to a standby master server: %v", err)
+		return
+	}
+	w.Header().Set(changesVersionTrailer, fmt.Sprintf("%v", version))
+}
+
+// Standby master server state as reported by the admin API
+type standbyStatus struct {
+	Primary  string     `json:"primary"`
+	Since    uint64     `json:"since"`               // Last version of the primary master server that was synced
+	LastSync *time.Time `json:"last_sync,omitempty"` // Empty if it never synced
+	Lag      float64    `json:"lag_seconds"`
+	Stale    bool       `json:"stale"`
+}
+
+// Handle reporting the state of a standby master server
+func standbyStatusHandler(w http.ResponseWriter, r *http.Request, s *standby) {
+	lag, stale := s.staleness(time.Duration(s.config.MaxStaleness) * time.Second)
+
+	s.mu.RLock()
+	status := standbyStatus{Primary: s.config.Primary, Since: s.since, Lag: lag.Seconds(), Stale: stale}
+	if !s.lastSync.IsZero() {
+		lastSync := s.lastSync
+		status.LastSync = &lastSync
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Handle retrieving keys from a standby master server
+// Reads are redirected to the primary master server while the copy of the
+// metadata is older than the staleness bound. Clients can lower the bound
+// of a read with the max_staleness parameter, in seconds
+func standbyGetHandler(w http.ResponseWriter, r *http.Request, s *standby) {
+	bound := time.Duration(s.config.MaxStaleness) * time.Second
+	if param := r.URL.Query().Get("max_staleness"); param != "" {
+		seconds, err := strconv.ParseFloat(param, 64)
+		if err != nil || seconds < 0 {
+			http.Error(w, "Max staleness must be a non-negative number of seconds", http.StatusBadRequest)
+			return
+		}
+		bound = time.Duration(seconds * float64(time.Second))
+	}
+
+	lag, stale := s.staleness(bound)
+	if stale {
+		redirectToPrimary(w, r, s)
+		return
+	}
+
+	w.Header().Set("X-Tdkvs-Standby-Lag", lag.Round(time.Millisecond).String())
+	getKeyHandler(w, r, s.c)
+}
+
+// Handle promoting a standby master server to primary
+// The old primary master server must be stopped first, since both would
+// accept writes otherwise
+func promoteHandler(w http.ResponseWriter, r *http.Request, s *standby) {
+	s.promoted.Do(func() {
+		log.Println("Promoting standby master server to primary")
+		close(s.promote)
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "promoting standby master server to primary")
+}
+
+// Redirect a request to the primary master server
+func redirectToPrimary(w http.ResponseWriter, r *http.Request, s *standby) {
+	// Temporary redirects keep the method and body of the request
+	http.Redirect(w, r, s.config.Primary+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// Handler of a standby master server
+// It serves reads and its own admin API, and redirects every other request
+// to the primary master server
+func standbyHandler(s *standby) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/", indexHandler).Methods("GET")
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
+		standbyGetHandler(w, r, s)
+	}).Methods("GET")
+	router.HandleFunc("/admin/standby", func(w http.ResponseWriter, r *http.Request) {
+		standbyStatusHandler(w, r, s)
+	}).Methods("GET")
+	router.HandleFunc("/admin/promote", func(w http.ResponseWriter, r *http.Request) {
+		promoteHandler(w, r, s)
+	}).Methods("POST")
+
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectToPrimary(w, r, s)
+	})
+	router.NotFoundHandler = redirect
+	router.MethodNotAllowedHandler = redirect
+	return router
+}
@@ -0,0 +1,43 @@
+package master
+
+import (
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// Transaction on the metadata of the master server
+// *badger.Txn implements it, so read-only transactions use BadgerDB directly
+type kvTxn interface {
+	Get(key []byte) (*badger.Item, error)
+	Set(key []byte, val []byte) error
+	Delete(key []byte) error
+	NewIterator(opt badger.IteratorOptions) *badger.Iterator
+}
+
+// BadgerDB holding the metadata of the master server
+// Reads always come from the local BadgerDB. When raft is enabled, writes
+// are replicated to a quorum of master servers before they are applied to
+// any of them
+type store struct {
+	*badger.DB
+
+	raft *raft.Raft // Replicates writes. Nil if raft is disabled
+	mu   sync.Mutex // Serializes replicated transactions
+}
+
+// Create a store over a BadgerDB that is not replicated
+func newStore(db *badger.DB) *store {
+	return &store{DB: db}
+}
+
+// Run a read-write transaction
+func (s *store) Update(fn func(txn kvTxn) error) error {
+	if s.raft == nil {
+		return s.DB.Update(func(txn *badger.Txn) error {
+			return fn(txn)
+		})
+	}
+	return s.replicate(fn)
+}
@@ -0,0 +1,39 @@
+package master
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits the amount of bytes per second that are transferred while
+// rebalancing, across all workers
+type throttle struct {
+	mu   sync.Mutex
+	rate int64     // Bytes per second. Zero means unlimited
+	next time.Time // Time at which the next transfer may start
+}
+
+// Create a throttle for the given amount of bytes per second
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate}
+}
+
+// Wait until the given amount of bytes may be transferred
+// Every transfer reserves the time it takes at the configured rate, so
+// transfers that come after it wait for it to be over
+func (t *throttle) wait(bytes int) {
+	if t == nil || t.rate <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	start := t.next
+	t.next = t.next.Add(time.Duration(float64(bytes) / float64(t.rate) * float64(time.Second)))
+	t.mu.Unlock()
+
+	time.Sleep(time.Until(start))
+}
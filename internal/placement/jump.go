@@ -0,0 +1,35 @@
+package placement
+
+import "github.com/orellazri/tdkvs/internal/utils"
+
+// Jump consistent hash
+// It needs no memory and spreads keys evenly. Adding a bucket only moves
+// keys to the new bucket, but only the last bucket can be removed cleanly
+type jump struct{}
+
+// Buckets are visited in the order of the re-seeded jump consistent hashes
+// of the key, so the first bucket is always the one of utils.ChooseBucket
+func (jump) Walk(hash uint64, numOfBuckets int, visit func(bucket uint32) bool) {
+	seen := make(map[uint32]bool)
+
+	// The amount of attempts is bounded, so the rest of the buckets are
+	// visited in order in the unlikely case that the re-seeded hashes keep
+	// colliding
+	maxAttempts := 32 * numOfBuckets
+	for attempt := 0; attempt < maxAttempts && len(seen) < numOfBuckets; attempt++ {
+		bucket := uint32(utils.ChooseReplicaBucket(hash, int32(numOfBuckets), attempt))
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+		if !visit(bucket) {
+			return
+		}
+	}
+
+	for bucket := uint32(0); bucket < uint32(numOfBuckets); bucket++ {
+		if !seen[bucket] && !visit(bucket) {
+			return
+		}
+	}
+}
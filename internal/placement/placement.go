@@ -0,0 +1,103 @@
+package placement
+
+import "fmt"
+
+// Names of the placement strategies that can be selected in the config
+const (
+	Jump       = "jump"
+	Rendezvous = "rendezvous"
+	Ring       = "ring"
+)
+
+// Strategy orders the buckets of a key by preference
+type Strategy interface {
+	// Call visit with every bucket once, in order of preference for the
+	// given hash, until it returns false
+	Walk(hash uint64, numOfBuckets int, visit func(bucket uint32) bool)
+}
+
+// Failure domains of a bucket
+type Domain struct {
+	Zone   string // Zone of the volume server. Empty if it is not labeled
+	Rack   string // Rack of the volume server within its zone. Empty if it is not labeled
+	Volume string // Volume server of the bucket
+}
+
+// Create the placement strategy with the given name
+// An empty name selects jump consistent hash
+func New(name string) (Strategy, error) {
+	switch name {
+	case "", Jump:
+		return jump{}, nil
+	case Rendezvous:
+		return rendezvous{}, nil
+	case Ring:
+		return newRing(defaultRingPoints), nil
+	default:
+		return nil, fmt.Errorf("unknown placement strategy \"%v\". Expected jump, rendezvous or ring", name)
+	}
+}
+
+// Choose numOfReplicas buckets for a hash, given the failure domains of
+// every bucket
+// No two buckets share a volume server. Buckets are spread over as many
+// zones as possible first, then over as many racks, so no two replicas
+// share a zone when there are enough zones. If there are less volume
+// servers than replicas, one bucket of every volume server is chosen
+func Choose(s Strategy, hash uint64, domains []Domain, numOfReplicas int) []uint32 {
+	zones := make(map[string]bool)
+	racks := make(map[string]bool)
+	volumes := make(map[string]bool)
+	for _, d := range domains {
+		zones[d.Zone] = true
+		racks[d.Zone+"/"+d.Rack] = true
+		volumes[d.Volume] = true
+	}
+	if numOfReplicas > len(volumes) {
+		numOfReplicas = len(volumes)
+	}
+
+	buckets := make([]uint32, 0, numOfReplicas)
+	usedZones := make(map[string]bool)
+	usedRacks := make(map[string]bool)
+	usedVolumes := make(map[string]bool)
+
+	// Every pass takes the buckets in order of preference that are in a domain
+	// that wasn't used yet, going from the widest domain to the narrowest
+	passes := []struct {
+		key   func(d Domain) string
+		used  map[string]bool
+		total int
+	}{
+		{func(d Domain) string { return d.Zone }, usedZones, len(zones)},
+		{func(d Domain) string { return d.Zone + "/" + d.Rack }, usedRacks, len(racks)},
+		{func(d Domain) string { return d.Volume }, usedVolumes, len(volumes)},
+	}
+	for _, pass := range passes {
+		if len(buckets) == numOfReplicas {
+			break
+		}
+
+		s.Walk(hash, len(domains), func(bucket uint32) bool {
+			d := domains[bucket]
+			if !pass.used[pass.key(d)] && !usedVolumes[d.Volume] {
+				usedZones[d.Zone] = true
+				usedRacks[d.Zone+"/"+d.Rack] = true
+				usedVolumes[d.Volume] = true
+				buckets = append(buckets, bucket)
+			}
+
+			// Stop when there are enough buckets or every domain was used
+			return len(buckets) < numOfReplicas && len(pass.used) < pass.total
+		})
+	}
+
+	return buckets
+}
+
+// Scramble a number (splitmix64 finalizer)
+func mix(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,132 @@
+package placement
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/orellazri/tdkvs/internal/utils"
+)
+
+// Every bucket in its own volume server
+func identityDomains(numOfBuckets int) []Domain {
+	domains := make([]Domain, numOfBuckets)
+	for i := range domains {
+		domains[i] = Domain{Volume: fmt.Sprint(i)}
+	}
+	return domains
+}
+
+func TestChooseDistinctVolumes(t *testing.T) {
+	// Five buckets in three volume servers with weights 2, 2 and 1
+	domains := []Domain{{Volume: "a"}, {Volume: "a"}, {Volume: "b"}, {Volume: "b"}, {Volume: "c"}}
+
+	for _, name := range []string{Jump, Rendezvous, Ring} {
+		strategy, err := New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 1000; i++ {
+			buckets := Choose(strategy, rand.Uint64(), domains, 3)
+			if len(buckets) != 3 {
+				t.Fatalf("%v: expected 3 buckets but got %v", name, len(buckets))
+			}
+
+			seen := make(map[string]bool)
+			for _, bucket := range buckets {
+				if int(bucket) >= len(domains) {
+					t.Fatalf("%v: bucket %v is out of range", name, bucket)
+				}
+				if seen[domains[bucket].Volume] {
+					t.Errorf("%v: volume server %v was chosen more than once", name, domains[bucket].Volume)
+				}
+				seen[domains[bucket].Volume] = true
+			}
+		}
+	}
+}
+
+func TestRemovingBucketOnlyMovesItsKeys(t *testing.T) {
+	// Removing the last bucket is the only removal jump consistent hash supports
+	for _, name := range []string{Jump, Rendezvous, Ring} {
+		strategy, err := New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 1000; i++ {
+			hash := rand.Uint64()
+			before := Choose(strategy, hash, identityDomains(10), 1)[0]
+			after := Choose(strategy, hash, identityDomains(9), 1)[0]
+			if before != 9 && before != after {
+				t.Fatalf("%v: key moved from bucket %v to %v", name, before, after)
+			}
+		}
+	}
+}
+
+func TestChooseDistinctZones(t *testing.T) {
+	// Six volume servers in three zones, two of which have two racks
+	domains := []Domain{
+		{Zone: "a", Rack: "1", Volume: "0"},
+		{Zone: "a", Rack: "1", Volume: "1"},
+		{Zone: "a", Rack: "2", Volume: "2"},
+		{Zone: "b", Rack: "1", Volume: "3"},
+		{Zone: "b", Rack: "2", Volume: "4"},
+		{Zone: "c", Rack: "1", Volume: "5"},
+	}
+
+	for _, name := range []string{Jump, Rendezvous, Ring} {
+		strategy, err := New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 1000; i++ {
+			hash := rand.Uint64()
+
+			// Enough zones for every replica
+			zones := make(map[string]bool)
+			for _, bucket := range Choose(strategy, hash, domains, 3) {
+				if zones[domains[bucket].Zone] {
+					t.Fatalf("%v: zone %v was chosen more than once", name, domains[bucket].Zone)
+				}
+				zones[domains[bucket].Zone] = true
+			}
+
+			// More replicas than zones. Every zone is used, and then every rack
+			zones = make(map[string]bool)
+			racks := make(map[string]bool)
+			for _, bucket := range Choose(strategy, hash, domains, 5) {
+				zones[domains[bucket].Zone] = true
+				racks[domains[bucket].Zone+domains[bucket].Rack] = true
+			}
+			if len(zones) != 3 || len(racks) != 5 {
+				t.Fatalf("%v: expected 3 zones and 5 racks but got %v and %v", name, len(zones), len(racks))
+			}
+		}
+	}
+}
+
+func TestChooseWithoutLabelsMatchesJump(t *testing.T) {
+	strategy, err := New(Jump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		hash := rand.Uint64()
+		buckets := Choose(strategy, hash, identityDomains(10), 3)
+		if buckets[0] != uint32(utils.ChooseBucket(hash, 10)) {
+			t.Fatalf("expected the first bucket to be %v but got %v", utils.ChooseBucket(hash, 10), buckets[0])
+		}
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	_, err := New("unknown")
+	if err == nil {
+		t.Error("expected an error for an unknown placement strategy")
+	}
+}
@@ -0,0 +1,25 @@
+package placement
+
+import "sort"
+
+// Rendezvous (highest random weight) hashing
+// Every bucket gets a score for the key and the buckets with the highest
+// scores are chosen. Adding or removing any bucket only moves the keys of
+// that bucket, at the cost of scoring every bucket for every key
+type rendezvous struct{}
+
+func (rendezvous) Walk(hash uint64, numOfBuckets int, visit func(bucket uint32) bool) {
+	order := make([]uint32, numOfBuckets)
+	scores := make([]uint64, numOfBuckets)
+	for i := range order {
+		order[i] = uint32(i)
+		scores[i] = mix(hash ^ mix(uint64(i)+1))
+	}
+	sort.Slice(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+
+	for _, bucket := range order {
+		if !visit(bucket) {
+			return
+		}
+	}
+}
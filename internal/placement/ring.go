@@ -0,0 +1,77 @@
+package placement
+
+import (
+	"sort"
+	"sync"
+)
+
+// Amount of points every bucket has on the ring
+const defaultRingPoints = 100
+
+// Point of a bucket on the ring
+type point struct {
+	hash   uint64
+	bucket uint32
+}
+
+// Consistent hashing on a ring
+// Every bucket owns points on a ring of hashes, and a key is stored in the
+// buckets of the next points clockwise from its hash. Adding or removing any
+// bucket only moves the keys of that bucket, but keys are spread less evenly
+// than with the other strategies and the ring is kept in memory
+type ring struct {
+	pointsPerBucket int
+
+	mu     sync.Mutex
+	points []point // Points of every bucket, sorted by hash
+}
+
+// Create a ring with the given amount of points for every bucket
+func newRing(pointsPerBucket int) *ring {
+	return &ring{pointsPerBucket: pointsPerBucket}
+}
+
+// Buckets are visited in the order their points are found walking the ring
+// clockwise from the hash of the key
+func (r *ring) Walk(hash uint64, numOfBuckets int, visit func(bucket uint32) bool) {
+	points := r.ring(numOfBuckets)
+	if len(points) == 0 {
+		return
+	}
+
+	start := sort.Search(len(points), func(i int) bool { return points[i].hash >= hash })
+	seen := make(map[uint32]bool)
+	for i := 0; i < len(points) && len(seen) < numOfBuckets; i++ {
+		bucket := points[(start+i)%len(points)].bucket
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+		if !visit(bucket) {
+			return
+		}
+	}
+}
+
+// Return the points of the ring for the given amount of buckets
+// The points of a bucket only depend on its number, so the ring is only
+// built again when buckets are added or removed
+func (r *ring) ring(numOfBuckets int) []point {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.points) == numOfBuckets*r.pointsPerBucket {
+		return r.points
+	}
+
+	points := make([]point, 0, numOfBuckets*r.pointsPerBucket)
+	for bucket := 0; bucket < numOfBuckets; bucket++ {
+		for i := 0; i < r.pointsPerBucket; i++ {
+			points = append(points, point{mix(uint64(bucket)<<32 | uint64(i)), uint32(bucket)})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	r.points = points
+	return points
+}
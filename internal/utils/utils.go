@@ -1,8 +1,18 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"hash/fnv"
 	"log"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 // Exit with a fatal log if an error occurred
@@ -35,10 +45,100 @@ func ChooseBucketString(key string, numOfBuckets int32) (uint64, uint32) {
 	return hash, uint32(ChooseBucket(hash, numOfBuckets))
 }
 
+// Choose a bucket for the given attempt of placing a replica of a key
+// The first attempt uses the key as is, so it always matches ChooseBucket.
+// Every following attempt re-seeds the key, which gives an independent
+// jump consistent hash that still moves as few keys as possible when buckets
+// are added
+func ChooseReplicaBucket(key uint64, numOfBuckets int32, attempt int) int32 {
+	if attempt == 0 {
+		return ChooseBucket(key, numOfBuckets)
+	}
+
+	// Mix the attempt number into the key (splitmix64 finalizer)
+	seed := key + uint64(attempt)*0x9e3779b97f4a7c15
+	seed = (seed ^ (seed >> 30)) * 0xbf58476d1ce4e5b9
+	seed = (seed ^ (seed >> 27)) * 0x94d049bb133111eb
+	seed = seed ^ (seed >> 31)
+
+	return ChooseBucket(seed, numOfBuckets)
+}
+
+// Generate a random (version 4) UUID, i.e. to identify a volume server
+func RandomID() (string, error) {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return "", err
+	}
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]), nil
+}
+
+// Return the hex encoded SHA-256 checksum of a value
+func Checksum(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// Hash a key with FNV-64
+// A new hasher is created for every key, so it is safe for concurrent use
 func HashString(key string) uint64 {
-	// TODO: Check if this is safe for concurrent use
 	hahser := fnv.New64()
 	hahser.Write([]byte(key))
 	hash := hahser.Sum64()
 	return hash
 }
+
+// Names of the key hash functions that can be selected in the config
+const (
+	HashFNV    = "fnv"
+	HashXX     = "xxhash"
+	HashSeeded = "seeded"
+)
+
+// Function that hashes keys
+type Hasher func(key string) uint64
+
+// Identify a hash function and its seed, i.e. to persist which one keys
+// were hashed with. The seed is only part of the seeded hash
+func HashID(name string, seed uint64) string {
+	if name == HashSeeded {
+		return fmt.Sprintf("%v:%v", name, seed)
+	}
+	return name
+}
+
+// Return the hash function identified by HashID
+func NewHasher(id string) (Hasher, error) {
+	parts := strings.SplitN(id, ":", 2)
+	switch {
+	case id == HashFNV:
+		return HashString, nil
+	case id == HashXX:
+		return xxhash.Sum64String, nil
+	case parts[0] == HashSeeded && len(parts) == 2:
+		seed, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || seed == 0 {
+			return nil, errors.New("the seeded hash needs a positive seed")
+		}
+		return seededHash(seed), nil
+	default:
+		return nil, fmt.Errorf("unknown hash function \"%v\". Expected fnv, xxhash or seeded", id)
+	}
+}
+
+// xxhash of keys prefixed with a secret seed, so the buckets of keys cannot
+// be predicted without the seed
+func seededHash(seed uint64) Hasher {
+	var prefix [8]byte
+	binary.BigEndian.PutUint64(prefix[:], seed)
+
+	return func(key string) uint64 {
+		digest := xxhash.New()
+		digest.Write(prefix[:])
+		digest.WriteString(key)
+		return digest.Sum64()
+	}
+}
@@ -14,3 +14,33 @@ func TestChooseBucketInRange(t *testing.T) {
 		}
 	}
 }
+
+func TestNewHasher(t *testing.T) {
+	for _, id := range []string{HashID(HashFNV, 0), HashID(HashXX, 0), HashID(HashSeeded, 42)} {
+		hasher, err := NewHasher(id)
+		if err != nil {
+			t.Fatalf("%v: %v", id, err)
+		}
+		if hasher("key") != hasher("key") {
+			t.Errorf("%v: expected the same hash for the same key", id)
+		}
+	}
+
+	fnv, _ := NewHasher(HashFNV)
+	if fnv("key") != HashString("key") {
+		t.Error("expected the fnv hash function to match HashString")
+	}
+
+	seeded1, _ := NewHasher(HashID(HashSeeded, 1))
+	seeded2, _ := NewHasher(HashID(HashSeeded, 2))
+	if seeded1("key") == seeded2("key") {
+		t.Error("expected different hashes for different seeds")
+	}
+
+	for _, id := range []string{"unknown", HashSeeded, HashID(HashSeeded, 0), "fnv:1"} {
+		_, err := NewHasher(id)
+		if err == nil {
+			t.Errorf("expected an error for hash function \"%v\"", id)
+		}
+	}
+}
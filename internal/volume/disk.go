@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package volume
+
+import "syscall"
+
+// Return the size and free bytes of the disk a path is on
+func diskUsage(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+	return stat.Blocks * uint64(stat.Bsize), stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -1,16 +1,84 @@
 package volume
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/orellazri/tdkvs/internal/utils"
 )
 
 type fileStorage struct {
 	path string
 }
 
+// Name of the file in the storage directory that holds its identity
+const identityFile = ".tdkvs_identity"
+
+// Prefix of the files that hold the metadata of values, next to them
+const metaPrefix = ".meta_"
+
+// Metadata stored alongside every value
+// Paths only hold the hash and the start of the key, so the master server
+// needs this to rebuild its metadata from the volume servers
+type keyMeta struct {
+	Key     string `json:"key"`
+	Hash    string `json:"hash"`
+	Size    int64  `json:"size"`
+	Partial bool   `json:"partial,omitempty"` // The value was stored without metadata, so the key is only the start of it
+}
+
+// Identity of a storage directory, so a master server can tell if a url
+// points to the volume server it expects
+type identity struct {
+	VolumeID  string `json:"volume_id"`  // Generated the first time the directory is used
+	ClusterID string `json:"cluster_id"` // Cluster of the master server that claimed the directory. Empty until it is claimed
+}
+
+// Load the identity of the storage directory
+// A new identity is generated and persisted the first time
+func (fs *fileStorage) loadIdentity() (*identity, error) {
+	id := &identity{}
+	data, err := os.ReadFile(filepath.Join(fs.path, identityFile))
+	if err == nil {
+		err = json.Unmarshal(data, id)
+		return id, err
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	id.VolumeID, err = utils.RandomID()
+	if err != nil {
+		return nil, err
+	}
+	err = fs.saveIdentity(id)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Persist the identity of the storage directory
+func (fs *fileStorage) saveIdentity(id *identity) error {
+	data, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(fs.path, 0777)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(fs.path, identityFile), data)
+}
+
 // Return a path, given a key and the key's hash
 // The path is the root volume path, the first two characters of the hash,
 // the first four characters of the hash, and the hash followed by
@@ -24,6 +92,40 @@ func (fs *fileStorage) keyToPath(key string, hash string) string {
 	return filepath.Join(fs.path, hash[:2], hash[:4], fmt.Sprintf("%v_%v", hash, truncatedKey))
 }
 
+// Return the path of the metadata of a value, given the path of the value
+func metaPath(valuePath string) string {
+	return filepath.Join(filepath.Dir(valuePath), metaPrefix+filepath.Base(valuePath))
+}
+
+// Write a file by writing to a temporary file which is then renamed, so a
+// crash in the middle of a write never leaves a partially written file behind
+func writeFile(filePath string, data []byte) error {
+	file, err := os.CreateTemp(path.Dir(filePath), ".tmp_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filePath)
+}
+
 // Retrieve a key
 func (fs *fileStorage) get(key string, hash string) ([]byte, error) {
 	path := fs.keyToPath(key, hash)
@@ -36,36 +138,43 @@ func (fs *fileStorage) get(key string, hash string) ([]byte, error) {
 }
 
 // Set value to key
+// The metadata of the value is written first, so a value is never stored
+// without it
 func (fs *fileStorage) set(key string, hash string, value []byte) error {
 	// TODO: Check mutex
 	filePath := fs.keyToPath(key, hash)
 
-	// Make directores and write to file
+	// Make directores and write the metadata and the value
 	err := os.MkdirAll(path.Dir(filePath), 0777)
 	if err != nil {
 		return err
 	}
 
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0777)
+	meta, err := json.Marshal(keyMeta{Key: key, Hash: hash, Size: int64(len(value))})
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	_, err = file.Write(value)
+	err = writeFile(metaPath(filePath), meta)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return writeFile(filePath, value)
 }
 
 // Delete key
 func (fs *fileStorage) delete(key string, hash string) error {
-	filePath := fs.keyToPath(key, hash)
+	return removeValue(fs.keyToPath(key, hash))
+}
 
-	// Remove file
+// Remove a value with its metadata, and its parent directories if they
+// are left empty
+func removeValue(filePath string) error {
+	// Remove file and its metadata
 	err := os.Remove(filePath)
+	if err == nil {
+		os.Remove(metaPath(filePath))
+	}
 
 	// Remove first parent directory if empty
 	dir := path.Dir(filePath)
@@ -77,3 +186,114 @@ func (fs *fileStorage) delete(key string, hash string) error {
 
 	return err
 }
+
+// Call a function with the metadata of every value in the storage directory
+// Values stored before their metadata was kept are listed as partial, with
+// the start of the key that is in their path
+func (fs *fileStorage) list(fn func(meta *keyMeta) error) error {
+	return filepath.WalkDir(fs.path, func(filePath string, entry os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && filePath == fs.path {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted while listing
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		meta := &keyMeta{}
+		data, err := os.ReadFile(metaPath(filePath))
+		if err == nil {
+			err = json.Unmarshal(data, meta)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			parts := strings.SplitN(entry.Name(), "_", 2)
+			if len(parts) != 2 {
+				return nil
+			}
+			meta = &keyMeta{Key: parts[1], Hash: parts[0], Partial: true}
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read metadata of %v: %w", filePath, err)
+		}
+
+		meta.Size = info.Size()
+		return fn(meta)
+	})
+}
+
+// Result of a garbage collection of the storage directory
+type collection struct {
+	Scanned int   `json:"scanned"` // Amount of values in the storage directory
+	Deleted int   `json:"deleted"` // Amount of values that were deleted
+	Bytes   int64 `json:"bytes"`   // Bytes freed by deleting values
+}
+
+// Delete the values whose paths are not referenced and that were last
+// written before the given time, with their metadata
+// Temporary files and metadata without a value, which are left behind by
+// crashes in the middle of writes, are deleted too once they are that old
+func (fs *fileStorage) collect(referenced map[string]bool, before time.Time) (*collection, error) {
+	result := &collection{}
+	err := filepath.WalkDir(fs.path, func(filePath string, entry os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || filePath == filepath.Join(fs.path, identityFile) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		old := info.ModTime().Before(before)
+
+		name := entry.Name()
+		switch {
+		case strings.HasPrefix(name, metaPrefix):
+			valuePath := filepath.Join(filepath.Dir(filePath), strings.TrimPrefix(name, metaPrefix))
+			if _, err := os.Stat(valuePath); errors.Is(err, os.ErrNotExist) && old {
+				os.Remove(filePath)
+			}
+		case strings.HasPrefix(name, "."):
+			if old {
+				os.Remove(filePath)
+			}
+		default:
+			result.Scanned++
+			if referenced[filePath] || !old {
+				return nil
+			}
+
+			err := removeValue(filePath)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			result.Deleted++
+			result.Bytes += info.Size()
+		}
+		return nil
+	})
+	return result, err
+}
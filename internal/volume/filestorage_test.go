@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 )
 
 func TestKeyToPath(t *testing.T) {
@@ -71,3 +72,146 @@ func TestSetDeleteKey(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestSetOverwriteKey(t *testing.T) {
+	tempDir := t.TempDir()
+	fs := fileStorage{path: tempDir}
+	key := "test"
+	hash := "123456789"
+
+	fs.set(key, hash, []byte("a longer value"))
+	fs.set(key, hash, []byte("short"))
+
+	actual, err := fs.get(key, hash)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(actual, []byte("short")) {
+		t.Errorf("expected %v but got %v", "short", string(actual))
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	fs := fileStorage{path: t.TempDir()}
+
+	id, err := fs.loadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.VolumeID == "" || id.ClusterID != "" {
+		t.Fatalf("expected a new unclaimed identity but got %+v", id)
+	}
+
+	id.ClusterID = "cluster"
+	err = fs.saveIdentity(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := fs.loadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *loaded != *id {
+		t.Errorf("expected identity %+v but got %+v", id, loaded)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	fs := fileStorage{path: t.TempDir()}
+
+	_, err := fs.loadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.set("a long key with spaces", "123456789", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A value stored before metadata was kept
+	legacy := fs.keyToPath("short", "987654321")
+	err = os.MkdirAll(path.Dir(legacy), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(legacy, []byte("legacy value"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(map[string]keyMeta)
+	err = fs.list(func(meta *keyMeta) error {
+		keys[meta.Key] = *meta
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]keyMeta{
+		"a long key with spaces": {Key: "a long key with spaces", Hash: "123456789", Size: 5},
+		"short":                  {Key: "short", Hash: "987654321", Size: 12, Partial: true},
+	}
+	if len(keys) != len(expected) {
+		t.Fatalf("expected keys %v but got %v", expected, keys)
+	}
+	for key, meta := range expected {
+		if keys[key] != meta {
+			t.Errorf("expected %+v but got %+v", meta, keys[key])
+		}
+	}
+
+	err = fs.delete("a long key with spaces", "123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(metaPath(fs.keyToPath("a long key with spaces", "123456789")))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected metadata to be deleted with the value but got %v", err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	fs := fileStorage{path: t.TempDir()}
+
+	id, err := fs.loadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"referenced", "orphan", "fresh"} {
+		err := fs.set(key, "123456789", []byte("value of "+key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Values written before the grace period
+	old := time.Now().Add(-time.Hour)
+	for _, key := range []string{"referenced", "orphan"} {
+		err := os.Chtimes(fs.keyToPath(key, "123456789"), old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	referenced := map[string]bool{fs.keyToPath("referenced", "123456789"): true}
+	result, err := fs.collect(referenced, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (collection{Scanned: 3, Deleted: 1, Bytes: int64(len("value of orphan"))}) {
+		t.Errorf("expected the old orphan to be deleted but got %+v", result)
+	}
+
+	for key, exists := range map[string]bool{"referenced": true, "orphan": false, "fresh": true} {
+		_, err := fs.get(key, "123456789")
+		if (err == nil) != exists {
+			t.Errorf("expected key %v to exist: %v, but got %v", key, exists, err)
+		}
+	}
+	if loaded, err := fs.loadIdentity(); err != nil || *loaded != *id {
+		t.Errorf("expected identity %+v to be kept but got %+v: %v", id, loaded, err)
+	}
+}
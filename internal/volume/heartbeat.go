@@ -0,0 +1,71 @@
+package volume
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Heartbeat a volume server sends to its master server
+type heartbeat struct {
+	URL       string `json:"url"`
+	VolumeID  string `json:"volume_id"`
+	ClusterID string `json:"cluster_id"`
+	DiskTotal uint64 `json:"disk_total"` // Size of the disk of the storage directory in bytes
+	DiskFree  uint64 `json:"disk_free"`  // Free bytes on the disk of the storage directory
+}
+
+// Announce the volume server to the master server and keep sending
+// heartbeats, so the master server knows it is alive
+func runHeartbeats(c *context, master string, url string, interval time.Duration) {
+	// Only log when the master server stops or starts accepting heartbeats,
+	// so a master server that is down doesn't flood the log
+	registered := false
+	for {
+		err := sendHeartbeat(c, master, url)
+		if err != nil && registered {
+			log.Printf("Could not send heartbeat to master server %v: %v", master, err)
+		}
+		if err == nil && !registered {
+			log.Printf("Registered with master server %v as %v", master, url)
+		}
+		registered = err == nil
+
+		time.Sleep(interval)
+	}
+}
+
+// Send a heartbeat to the master server
+func sendHeartbeat(c *context, master string, url string) error {
+	c.mu.Lock()
+	id := *c.identity
+	c.mu.Unlock()
+
+	total, free, err := diskUsage(c.fs.path)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(heartbeat{url, id.VolumeID, id.ClusterID, total, free})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(fmt.Sprintf("%v/admin/heartbeat", master), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		message, _ := io.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+	return nil
+}
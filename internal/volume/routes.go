@@ -1,15 +1,20 @@
 package volume
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/orellazri/tdkvs/internal/utils"
 )
 
 // Handle index route
@@ -17,6 +22,52 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "tdkvs volume server running")
 }
 
+// Handle retrieving the identity of the volume server
+func identityHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	c.mu.Lock()
+	id := *c.identity
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(id)
+}
+
+// Handle a master server claiming the volume server for its cluster, given
+// with the `cluster` query parameter
+// A volume server can only belong to one cluster, so a master server of
+// another cluster never uses its data
+func claimHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	cluster := r.URL.Query().Get("cluster")
+	if cluster == "" {
+		http.Error(w, "Invalid cluster", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.identity.ClusterID != "" && c.identity.ClusterID != cluster {
+		http.Error(w, fmt.Sprintf("Volume server belongs to cluster %v", c.identity.ClusterID), http.StatusConflict)
+		return
+	}
+
+	if c.identity.ClusterID == "" {
+		claimed := *c.identity
+		claimed.ClusterID = cluster
+		err := c.fs.saveIdentity(&claimed)
+		if err != nil {
+			http.Error(w, "An error occurred while saving the identity", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		c.identity = &claimed
+		log.Printf("Claimed by cluster %v", cluster)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.identity)
+}
+
 // Handle retrieveing keys
 func getKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 	key := mux.Vars(r)["key"]
@@ -47,11 +98,98 @@ func getKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 		fmt.Fprintf(w, "%v", binary.BigEndian.Uint64(value))
 	case "string":
 		fmt.Fprintf(w, "%v", string(value))
+	case "raw":
+		w.Write(value)
 	default:
 		fmt.Fprintf(w, "%v", value)
 	}
 }
 
+// Handle retrieving the checksum of a key's value
+func checksumHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	key := mux.Vars(r)["key"]
+	hash := r.URL.Query().Get("hash")
+	if key == "" || hash == "" {
+		http.Error(w, "Invalid key or hash", http.StatusBadRequest)
+		return
+	}
+
+	value, err := c.fs.get(key, hash)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("Key \"%v\" does not exist", key), http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("An error occurred while retrieving key \"%v\"", key), http.StatusInternalServerError)
+			log.Println(err)
+		}
+
+		return
+	}
+
+	fmt.Fprintf(w, "%v", utils.Checksum(value))
+}
+
+// Response of a push to another volume server
+type pushResponse struct {
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// Handle pushing a key's value directly to another volume server
+// This lets the master server move keys without the value going through it
+// The value is stored under the `to_hash` query parameter in the destination
+// if it is given, i.e. when keys are rehashed
+func pushHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	key := mux.Vars(r)["key"]
+	hash := r.URL.Query().Get("hash")
+	to := r.URL.Query().Get("to")
+	if key == "" || hash == "" || to == "" {
+		http.Error(w, "Invalid key, hash or destination", http.StatusBadRequest)
+		return
+	}
+	toHash := r.URL.Query().Get("to_hash")
+	if toHash == "" {
+		toHash = hash
+	}
+
+	value, err := c.fs.get(key, hash)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("Key \"%v\" does not exist", key), http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("An error occurred while retrieving key \"%v\"", key), http.StatusInternalServerError)
+			log.Println(err)
+		}
+		return
+	}
+
+	// Send request to the destination volume server
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%v/set/%v?hash=%v", to, key, toHash), bytes.NewReader(value))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("An error occurred while pushing key \"%v\"", key), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("An error occurred while pushing key \"%v\"", key), http.StatusBadGateway)
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		http.Error(w, fmt.Sprintf("Volume server %v did not accept key \"%v\"", to, key), http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("Pushed key \"%v\" to %v", key, to)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pushResponse{len(value), utils.Checksum(value)})
+}
+
 // Handle settings keys
 func setKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 	key := mux.Vars(r)["key"]
@@ -91,8 +229,12 @@ func deleteKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 
 	err := c.fs.delete(key, hash)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("An error occurred while deleting key \"%v\"", key), http.StatusInternalServerError)
-		log.Println(err)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("Key \"%v\" does not exist", key), http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("An error occurred while deleting key \"%v\"", key), http.StatusInternalServerError)
+			log.Println(err)
+		}
 		return
 	}
 
@@ -100,3 +242,84 @@ func deleteKeyHandler(w http.ResponseWriter, r *http.Request, c *context) {
 
 	fmt.Fprintf(w, "ok")
 }
+
+// Trailer of the keys listing with the amount of keys in it. A listing
+// without it was cut short
+const keysCountTrailer = "X-Tdkvs-Count"
+
+// Handle listing the keys stored in the volume server with their metadata,
+// one JSON object per line
+func keysHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", keysCountTrailer)
+
+	count := 0
+	encoder := json.NewEncoder(w)
+	err := c.fs.list(func(meta *keyMeta) error {
+		count++
+		return encoder.Encode(meta)
+	})
+	if err != nil {
+		log.Printf("Could not list keys: %v", err)
+		return
+	}
+
+	w.Header().Set(keysCountTrailer, fmt.Sprintf("%v", count))
+}
+
+// Key that the master server references in the volume server
+type referencedKey struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+}
+
+// Handle a garbage collection requested by the master server
+// The body lists every key the master server references in the volume
+// server, one JSON object per line, with the amount of keys in the
+// X-Tdkvs-Count trailer. Values that are not referenced are deleted once
+// they are older than the `grace` query parameter, in seconds, so values
+// written while the master server was listing the keys are kept
+func gcHandler(w http.ResponseWriter, r *http.Request, c *context) {
+	grace, err := strconv.Atoi(r.URL.Query().Get("grace"))
+	if err != nil || grace < 0 {
+		http.Error(w, "Grace must be a non-negative number of seconds", http.StatusBadRequest)
+		return
+	}
+	before := time.Now().Add(-time.Duration(grace) * time.Second)
+
+	referenced := make(map[string]bool)
+	listed := 0
+	decoder := json.NewDecoder(r.Body)
+	for {
+		k := &referencedKey{}
+		err := decoder.Decode(k)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil || k.Key == "" || len(k.Hash) < 4 {
+			http.Error(w, "Invalid list of referenced keys", http.StatusBadRequest)
+			return
+		}
+		referenced[c.fs.keyToPath(k.Key, k.Hash)] = true
+		listed++
+	}
+
+	// Nothing is deleted unless the whole list arrived
+	count, err := strconv.Atoi(r.Trailer.Get(keysCountTrailer))
+	if err != nil || count != listed {
+		http.Error(w, "List of referenced keys was cut short", http.StatusBadRequest)
+		return
+	}
+
+	result, err := c.fs.collect(referenced, before)
+	if err != nil {
+		http.Error(w, "An error occurred while collecting garbage", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Collected garbage: deleted %v of %v values, freeing %v bytes", result.Deleted, result.Scanned, result.Bytes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -4,19 +4,30 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/orellazri/tdkvs/internal/utils"
 )
 
 // Config struct to unmarshal from yaml file for the volume server
 type Config struct {
 	Port int    // Server port
 	Path string // Path to file storage directory
+
+	Master            string // Optional. Url of the master server to register with and send heartbeats to
+	URL               string // Optional. Url the master server reaches this volume server at (defaults to http://localhost:<port>)
+	HeartbeatInterval int    `yaml:"heartbeat_interval"` // Optional. Seconds between heartbeats (defaults to 5)
 }
 
 // Context for global state
 type context struct {
 	fs *fileStorage
+
+	mu       sync.Mutex // Protects the identity
+	identity *identity  // Identity of the storage directory
 }
 
 // Start volume server
@@ -26,15 +37,52 @@ func Start(config *Config) {
 	fs := &fileStorage{
 		path: config.Path,
 	}
+	id, err := fs.loadIdentity()
+	utils.AbortOnError(err)
+	if id.ClusterID == "" {
+		log.Printf("Volume id is %v. Waiting for a master server to claim it", id.VolumeID)
+	} else {
+		log.Printf("Volume id is %v in cluster %v", id.VolumeID, id.ClusterID)
+	}
+
 	context := &context{
-		fs,
+		fs:       fs,
+		identity: id,
+	}
+
+	if config.Master != "" {
+		if config.URL == "" {
+			config.URL = fmt.Sprintf("http://localhost:%v", config.Port)
+		}
+		if config.HeartbeatInterval <= 0 {
+			config.HeartbeatInterval = 5
+		}
+		go runHeartbeats(context, strings.TrimSuffix(config.Master, "/"), strings.TrimSuffix(config.URL, "/"), time.Duration(config.HeartbeatInterval)*time.Second)
 	}
 
 	router := mux.NewRouter()
 	router.HandleFunc("/", indexHandler).Methods("GET")
+	router.HandleFunc("/identity", func(w http.ResponseWriter, r *http.Request) {
+		identityHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/identity", func(w http.ResponseWriter, r *http.Request) {
+		claimHandler(w, r, context)
+	}).Methods("POST")
+	router.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		keysHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
+		gcHandler(w, r, context)
+	}).Methods("POST")
 	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {
 		getKeyHandler(w, r, context)
 	}).Methods("GET")
+	router.HandleFunc("/checksum/{key}", func(w http.ResponseWriter, r *http.Request) {
+		checksumHandler(w, r, context)
+	}).Methods("GET")
+	router.HandleFunc("/push/{key}", func(w http.ResponseWriter, r *http.Request) {
+		pushHandler(w, r, context)
+	}).Methods("POST")
 	router.HandleFunc("/set/{key}", func(w http.ResponseWriter, r *http.Request) {
 		setKeyHandler(w, r, context)
 	}).Methods("PUT")